@@ -4,21 +4,41 @@ package appconfig
 // The properties are generally defined in https://github.com/superfly/flyctl/blob/master/internal/appconfig/config.go#L38 but
 // we only support a subset of these.
 type AppConfig struct {
-	AppName      string                   `toml:"app,omitempty" json:"app,omitempty"`
-	Build        *Build                   `toml:"build,omitempty" json:"build,omitempty"`
-	Checks       map[string]TopLevelCheck `toml:"checks,omitempty" json:"checks,omitempty"`
-	Env          map[string]string        `toml:"env,omitempty" json:"env,omitempty"`
-	Experimental *Experimental            `toml:"experimental,omitempty" json:"experimental,omitempty"`
-	Files        []File                   `toml:"files,omitempty" json:"files,omitempty"`
-	Mounts       []Mount                  `toml:"mounts,omitempty" json:"mounts,omitempty"`
-	Services     []Service                `toml:"services,omitempty" json:"services,omitempty"`
-	Vm           *Vm                      `toml:"vm,omitempty" json:"vm,omitempty"`
+	AppName       string                   `toml:"app,omitempty" json:"app,omitempty"`
+	Build         *Build                   `toml:"build,omitempty" json:"build,omitempty"`
+	Checks        map[string]TopLevelCheck `toml:"checks,omitempty" json:"checks,omitempty"`
+	Deploy        *Deploy                  `toml:"deploy,omitempty" json:"deploy,omitempty"`
+	Env           map[string]string        `toml:"env,omitempty" json:"env,omitempty"`
+	Experimental  *Experimental            `toml:"experimental,omitempty" json:"experimental,omitempty"`
+	Files         []File                   `toml:"files,omitempty" json:"files,omitempty"`
+	HttpService   *HttpService             `toml:"http_service,omitempty" json:"http_service,omitempty"`
+	KillSignal    string                   `toml:"kill_signal,omitempty" json:"kill_signal,omitempty"`
+	KillTimeout   string                   `toml:"kill_timeout,omitempty" json:"kill_timeout,omitempty"`
+	Metrics       []Metrics                `toml:"metrics,omitempty" json:"metrics,omitempty"`
+	Mounts        []Mount                  `toml:"mounts,omitempty" json:"mounts,omitempty"`
+	PrimaryRegion string                   `toml:"primary_region,omitempty" json:"primary_region,omitempty"`
+	Processes     map[string]string        `toml:"processes,omitempty" json:"processes,omitempty"`
+	Restart       []Restart                `toml:"restart,omitempty" json:"restart,omitempty"`
+	Services      []Service                `toml:"services,omitempty" json:"services,omitempty"`
+	Statics       []Static                 `toml:"statics,omitempty" json:"statics,omitempty"`
+	SwapSizeMb    *int                     `toml:"swap_size_mb,omitempty" json:"swap_size_mb,omitempty"`
+	// Vm is either a single *Vm table for the whole app or a []Vm list where each entry is scoped to process groups.
+	Vm interface{} `toml:"vm,omitempty" json:"vm,omitempty"`
 }
 
 type Build struct {
-	Dockerfile string `toml:"dockerfile,omitempty" json:"dockerfile,omitempty"`
-	IgnoreFile string `toml:"ignorefile,omitempty" json:"ignorefile,omitempty"`
-	Image      string `toml:"image,omitempty" json:"image,omitempty"`
+	Args        map[string]string `toml:"args,omitempty" json:"args,omitempty"`
+	BuildTarget string            `toml:"build-target,omitempty" json:"build-target,omitempty"`
+	Dockerfile  string            `toml:"dockerfile,omitempty" json:"dockerfile,omitempty"`
+	IgnoreFile  string            `toml:"ignorefile,omitempty" json:"ignorefile,omitempty"`
+	Image       string            `toml:"image,omitempty" json:"image,omitempty"`
+}
+
+type Deploy struct {
+	MaxUnavailable *float64 `toml:"max_unavailable,omitempty" json:"max_unavailable,omitempty"`
+	ReleaseCommand string   `toml:"release_command,omitempty" json:"release_command,omitempty"`
+	Strategy       string   `toml:"strategy,omitempty" json:"strategy,omitempty"`
+	WaitTimeout    string   `toml:"wait_timeout,omitempty" json:"wait_timeout,omitempty"`
 }
 
 type Experimental struct {
@@ -27,20 +47,42 @@ type Experimental struct {
 }
 
 type Vm struct {
-	Cpus   int    `toml:"cpus,omitempty" json:"cpus,omitempty"`
-	Memory string `toml:"memory,omitempty" json:"memory,omitempty"`
+	CpuKind   string   `toml:"cpu_kind,omitempty" json:"cpu_kind,omitempty"`
+	Cpus      int      `toml:"cpus,omitempty" json:"cpus,omitempty"`
+	Memory    string   `toml:"memory,omitempty" json:"memory,omitempty"`
+	Processes []string `toml:"processes,omitempty" json:"processes,omitempty"`
+	Size      string   `toml:"size,omitempty" json:"size,omitempty"`
+}
+
+type Metrics struct {
+	Path      string   `toml:"path,omitempty" json:"path,omitempty"`
+	Port      int      `toml:"port,omitempty" json:"port,omitempty"`
+	Processes []string `toml:"processes,omitempty" json:"processes,omitempty"`
 }
 
 type Mount struct {
-	Destination string `toml:"destination,omitempty" json:"destination,omitempty"`
-	Source      string `toml:"source,omitempty" json:"source,omitempty"`
+	AutoExtendSizeIncrement string   `toml:"auto_extend_size_increment,omitempty" json:"auto_extend_size_increment,omitempty"`
+	AutoExtendSizeLimit     string   `toml:"auto_extend_size_limit,omitempty" json:"auto_extend_size_limit,omitempty"`
+	AutoExtendSizeThreshold *int     `toml:"auto_extend_size_threshold,omitempty" json:"auto_extend_size_threshold,omitempty"`
+	Destination             string   `toml:"destination,omitempty" json:"destination,omitempty"`
+	InitialSize             string   `toml:"initial_size,omitempty" json:"initial_size,omitempty"`
+	Processes               []string `toml:"processes,omitempty" json:"processes,omitempty"`
+	SnapshotRetention       *int     `toml:"snapshot_retention,omitempty" json:"snapshot_retention,omitempty"`
+	Source                  string   `toml:"source,omitempty" json:"source,omitempty"`
 }
 
 type File struct {
-	GuestPath  string  `toml:"guest_path,omitempty" json:"guest_path,omitempty"`
-	LocalPath  *string `toml:"local_path,omitempty" json:"local_path,omitempty"`
-	RawValue   *string `toml:"raw_value,omitempty" json:"raw_value,omitempty"`
-	SecretName *string `toml:"secret_name,omitempty" json:"secret_name,omitempty"`
+	GuestPath  string   `toml:"guest_path,omitempty" json:"guest_path,omitempty"`
+	LocalPath  *string  `toml:"local_path,omitempty" json:"local_path,omitempty"`
+	Processes  []string `toml:"processes,omitempty" json:"processes,omitempty"`
+	RawValue   *string  `toml:"raw_value,omitempty" json:"raw_value,omitempty"`
+	SecretName *string  `toml:"secret_name,omitempty" json:"secret_name,omitempty"`
+}
+
+type Restart struct {
+	Policy    string   `toml:"policy,omitempty" json:"policy,omitempty"`
+	Processes []string `toml:"processes,omitempty" json:"processes,omitempty"`
+	Retries   *int     `toml:"retries,omitempty" json:"retries,omitempty"`
 }
 
 type Service struct {
@@ -51,7 +93,22 @@ type Service struct {
 	InternalPort       int                    `toml:"internal_port,omitempty" json:"internal_port,omitempty"`
 	MinMachinesRunning int                    `toml:"min_machines_running,omitempty" json:"min_machines_running,omitempty"`
 	Ports              []ServicePort          `toml:"ports,omitempty" json:"ports,omitempty"`
+	Processes          []string               `toml:"processes,omitempty" json:"processes,omitempty"`
 	Protocol           string                 `toml:"protocol,omitempty" json:"protocol,omitempty"`
+	TcpChecks          []TcpCheck             `toml:"tcp_checks,omitempty" json:"tcp_checks,omitempty"`
+}
+
+// HttpService is the simplified service definition which exposes the internal port on 80 (http) and 443 (tls,http).
+type HttpService struct {
+	AutoStartMachines  bool                   `toml:"auto_start_machines,omitempty" json:"auto_start_machines,omitempty"`
+	AutoStopMachines   string                 `toml:"auto_stop_machines,omitempty" json:"auto_stop_machines,omitempty"`
+	Checks             []HttpCheck            `toml:"checks,omitempty" json:"checks,omitempty"`
+	Concurrency        map[string]interface{} `toml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	ForceHttps         bool                   `toml:"force_https,omitempty" json:"force_https,omitempty"`
+	HttpOptions        map[string]interface{} `toml:"http_options,omitempty" json:"http_options,omitempty"`
+	InternalPort       int                    `toml:"internal_port,omitempty" json:"internal_port,omitempty"`
+	MinMachinesRunning int                    `toml:"min_machines_running,omitempty" json:"min_machines_running,omitempty"`
+	Processes          []string               `toml:"processes,omitempty" json:"processes,omitempty"`
 }
 
 type ServicePort struct {
@@ -61,18 +118,37 @@ type ServicePort struct {
 }
 
 type HttpCheck struct {
+	GracePeriod   string            `toml:"grace_period,omitempty" json:"grace_period,omitempty"`
 	Headers       map[string]string `toml:"headers,omitempty" json:"headers,omitempty"`
+	Interval      string            `toml:"interval,omitempty" json:"interval,omitempty"`
 	Method        string            `toml:"method,omitempty" json:"method,omitempty"`
 	Path          string            `toml:"path,omitempty" json:"path,omitempty"`
 	Protocol      string            `toml:"protocol,omitempty" json:"protocol,omitempty"`
+	Timeout       string            `toml:"timeout,omitempty" json:"timeout,omitempty"`
 	TlsServerName string            `toml:"tls_server_name,omitempty" json:"tls_server_name,omitempty"`
 	TlsSkipVerify bool              `toml:"tls_skip_verify,omitempty" json:"tls_skip_verify,omitempty"`
 }
 
+type Static struct {
+	GuestPath string   `toml:"guest_path,omitempty" json:"guest_path,omitempty"`
+	Processes []string `toml:"processes,omitempty" json:"processes,omitempty"`
+	UrlPrefix string   `toml:"url_prefix,omitempty" json:"url_prefix,omitempty"`
+}
+
+type TcpCheck struct {
+	GracePeriod string `toml:"grace_period,omitempty" json:"grace_period,omitempty"`
+	Interval    string `toml:"interval,omitempty" json:"interval,omitempty"`
+	Timeout     string `toml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
 type TopLevelCheck struct {
-	Headers map[string]string `toml:"headers,omitempty" json:"headers,omitempty"`
-	Method  string            `toml:"method,omitempty" json:"method,omitempty"`
-	Path    string            `toml:"path,omitempty" json:"path,omitempty"`
-	Port    int               `toml:"port,omitempty" json:"port,omitempty"`
-	Type    string            `toml:"type,omitempty" json:"type,omitempty"`
+	GracePeriod string            `toml:"grace_period,omitempty" json:"grace_period,omitempty"`
+	Headers     map[string]string `toml:"headers,omitempty" json:"headers,omitempty"`
+	Interval    string            `toml:"interval,omitempty" json:"interval,omitempty"`
+	Method      string            `toml:"method,omitempty" json:"method,omitempty"`
+	Path        string            `toml:"path,omitempty" json:"path,omitempty"`
+	Port        int               `toml:"port,omitempty" json:"port,omitempty"`
+	Processes   []string          `toml:"processes,omitempty" json:"processes,omitempty"`
+	Timeout     string            `toml:"timeout,omitempty" json:"timeout,omitempty"`
+	Type        string            `toml:"type,omitempty" json:"type,omitempty"`
 }
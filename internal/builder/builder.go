@@ -0,0 +1,162 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Request describes a Dockerfile build that is pushed to a registry.
+type Request struct {
+	// ContextDir is the directory sent as the build context.
+	ContextDir string
+	Dockerfile string
+	// Image is the image reference including the tag that the build is pushed to.
+	Image  string
+	Args   map[string]string
+	Target string
+	// Secrets maps each build secret id to either a file path or env:<NAME> to read it from an environment variable.
+	Secrets map[string]string
+}
+
+// Builder builds and pushes an image and returns the digest of the pushed image.
+type Builder interface {
+	Build(ctx context.Context, req Request, stderr io.Writer) (string, error)
+}
+
+const externalPrefix = "cmd:"
+
+var digestReg = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// New returns the builder for the given kind: docker for docker buildx, buildkit for buildctl, or cmd:<binary> for an
+// external command.
+func New(kind string) (Builder, error) {
+	switch {
+	case kind == "docker":
+		return &dockerBuilder{}, nil
+	case kind == "buildkit":
+		return &buildkitBuilder{}, nil
+	case strings.HasPrefix(kind, externalPrefix) && len(kind) > len(externalPrefix):
+		return &externalBuilder{Binary: strings.TrimPrefix(kind, externalPrefix)}, nil
+	}
+	return nil, fmt.Errorf("unknown builder '%s', expected docker, buildkit, or cmd:<binary>", kind)
+}
+
+// secretFlag returns the --secret flag value that is understood by both docker buildx and buildctl.
+func secretFlag(id string, source string) string {
+	if name, ok := strings.CutPrefix(source, "env:"); ok {
+		return fmt.Sprintf("id=%s,env=%s", id, name)
+	}
+	return fmt.Sprintf("id=%s,src=%s", id, source)
+}
+
+// runWithMetadata runs the build command with a --metadata-file flag and returns the image digest from it.
+func runWithMetadata(ctx context.Context, binary string, args []string, stderr io.Writer) (string, error) {
+	f, err := os.CreateTemp("", "build-metadata-*.json")
+	if err != nil {
+		return "", fmt.Errorf("failed to create metadata file: %w", err)
+	}
+	_ = f.Close()
+	defer os.Remove(f.Name())
+	args = append(args, "--metadata-file", f.Name())
+	slog.Info("Building image", slog.String("cmd", binary), slog.Any("args", args))
+	c := exec.CommandContext(ctx, binary, args...)
+	c.Stdout = stderr
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("failed to run %s: %w", binary, err)
+	}
+	raw, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata file: %w", err)
+	}
+	var metadata struct {
+		Digest string `json:"containerimage.digest"`
+	}
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return "", fmt.Errorf("failed to decode metadata file: %w", err)
+	} else if !digestReg.MatchString(metadata.Digest) {
+		return "", fmt.Errorf("metadata file does not contain an image digest")
+	}
+	return metadata.Digest, nil
+}
+
+type dockerBuilder struct{}
+
+func (d *dockerBuilder) Build(ctx context.Context, req Request, stderr io.Writer) (string, error) {
+	args := []string{"buildx", "build", "--push", "--file", req.Dockerfile, "--tag", req.Image}
+	for _, k := range slices.Sorted(maps.Keys(req.Args)) {
+		args = append(args, "--build-arg", k+"="+req.Args[k])
+	}
+	if req.Target != "" {
+		args = append(args, "--target", req.Target)
+	}
+	for _, id := range slices.Sorted(maps.Keys(req.Secrets)) {
+		args = append(args, "--secret", secretFlag(id, req.Secrets[id]))
+	}
+	return runWithMetadata(ctx, "docker", append(args, req.ContextDir), stderr)
+}
+
+type buildkitBuilder struct{}
+
+func (b *buildkitBuilder) Build(ctx context.Context, req Request, stderr io.Writer) (string, error) {
+	args := []string{
+		"build", "--frontend", "dockerfile.v0",
+		"--local", "context=" + req.ContextDir,
+		"--local", "dockerfile=" + filepath.Dir(req.Dockerfile),
+		"--opt", "filename=" + filepath.Base(req.Dockerfile),
+		"--output", "type=image,name=" + req.Image + ",push=true",
+	}
+	for _, k := range slices.Sorted(maps.Keys(req.Args)) {
+		args = append(args, "--opt", "build-arg:"+k+"="+req.Args[k])
+	}
+	if req.Target != "" {
+		args = append(args, "--opt", "target="+req.Target)
+	}
+	for _, id := range slices.Sorted(maps.Keys(req.Secrets)) {
+		args = append(args, "--secret", secretFlag(id, req.Secrets[id]))
+	}
+	return runWithMetadata(ctx, "buildctl", args, stderr)
+}
+
+// externalBuilder runs a command with the build request in SCORE_BUILD_* environment variables. The command must build
+// and push the image and print the digest as the last line of its output.
+type externalBuilder struct {
+	Binary string
+}
+
+func (e *externalBuilder) Build(ctx context.Context, req Request, stderr io.Writer) (string, error) {
+	rawArgs, _ := json.Marshal(req.Args)
+	rawSecrets, _ := json.Marshal(req.Secrets)
+	c := exec.CommandContext(ctx, e.Binary)
+	c.Env = append(os.Environ(),
+		"SCORE_BUILD_CONTEXT="+req.ContextDir,
+		"SCORE_BUILD_DOCKERFILE="+req.Dockerfile,
+		"SCORE_BUILD_IMAGE="+req.Image,
+		"SCORE_BUILD_TARGET="+req.Target,
+		"SCORE_BUILD_ARGS="+string(rawArgs),
+		"SCORE_BUILD_SECRETS="+string(rawSecrets),
+	)
+	stdout := new(bytes.Buffer)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	slog.Info("Building image", slog.String("cmd", e.Binary), slog.String("image", req.Image))
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("failed to run build command: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if digest := strings.TrimSpace(lines[len(lines)-1]); digestReg.MatchString(digest) {
+		return digest, nil
+	}
+	return "", fmt.Errorf("build command did not print an image digest as the last line of output")
+}
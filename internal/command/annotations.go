@@ -0,0 +1,38 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/astromechza/score-flyio/internal/convert"
+)
+
+var (
+	annotationsGroup = &cobra.Command{
+		Use:   "annotations",
+		Short: "inspect the supported workload annotations",
+	}
+
+	annotationsSchema = &cobra.Command{
+		Use:           "schema",
+		Short:         "print the JSON schema of the supported workload annotations",
+		Args:          cobra.NoArgs,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(convert.AnnotationsJsonSchema()); err != nil {
+				return fmt.Errorf("failed to encode schema: %w", err)
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	annotationsGroup.AddCommand(annotationsSchema)
+	rootCmd.AddCommand(annotationsGroup)
+}
@@ -0,0 +1,95 @@
+package command
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/astromechza/score-flyio/internal/builder"
+	"github.com/astromechza/score-flyio/internal/convert"
+	"github.com/astromechza/score-flyio/internal/flymachines"
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+const flyRegistry = "registry.fly.io"
+
+// buildWorkloadImages builds and pushes the Dockerfile next to the Score file for each container with image '.' and
+// replaces the image with the pushed image digest.
+func buildWorkloadImages(cmd *cobra.Command, currentState *state.State, workloadName string) error {
+	workload := currentState.Workloads[workloadName]
+	containerNames := slices.Sorted(maps.Keys(workload.Spec.Containers))
+	containerNames = slices.DeleteFunc(containerNames, func(name string) bool {
+		return workload.Spec.Containers[name].Image != "."
+	})
+	if len(containerNames) == 0 {
+		slog.Info("No containers with image '.' to build", slog.String("workload", workloadName))
+		return nil
+	} else if workload.File == nil {
+		return fmt.Errorf("cannot build without a Score file to locate the Dockerfile")
+	} else if group := convert.AppGroup(currentState, workloadName); group != "" && len(convert.GroupWorkloads(currentState, group)) > 1 {
+		// the other workloads in the group would keep their previous image and conflict with the newly built one
+		return fmt.Errorf("cannot build workloads in app group '%s' since all workloads in the group must share an image, build and push the image separately instead", group)
+	}
+
+	kind, _ := cmd.Flags().GetString(generateCmdBuilderFlag)
+	b, err := builder.New(kind)
+	if err != nil {
+		return err
+	}
+	opts, err := convert.WorkloadBuildOptions(currentState, workloadName)
+	if err != nil {
+		return err
+	}
+	app := convert.AppName(currentState, workloadName)
+	registry, _ := cmd.Flags().GetString(generateCmdBuildRegistryFlag)
+	tag, _ := cmd.Flags().GetString(generateCmdBuildTagFlag)
+	if tag == "" {
+		tag = "deployment-" + time.Now().UTC().Format("20060102150405")
+	}
+	if registry == flyRegistry {
+		// the app must exist before images can be pushed to its repository in the fly registry
+		client, err := flymachines.NewFlyClient()
+		if err != nil {
+			return fmt.Errorf("failed to setup fly api client: %w", err)
+		}
+		ingress, err := flymachines.NewIngress()
+		if err != nil {
+			return fmt.Errorf("failed to setup fly api client: %w", err)
+		} else if err := ingress.EnsureApp(app); err != nil {
+			return err
+		}
+		c := exec.Command("fly", "auth", "docker", "--access-token", client.ApiToken)
+		c.Stdout = cmd.ErrOrStderr()
+		c.Stderr = cmd.ErrOrStderr()
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("failed to authenticate docker with the fly registry: %w", err)
+		}
+	}
+
+	image := fmt.Sprintf("%s/%s:%s", registry, app, tag)
+	dir := filepath.Dir(*workload.File)
+	digest, err := b.Build(cmd.Context(), builder.Request{
+		ContextDir: dir,
+		Dockerfile: filepath.Join(dir, "Dockerfile"),
+		Image:      image,
+		Args:       opts.Args,
+		Target:     opts.Target,
+		Secrets:    opts.Secrets,
+	}, cmd.ErrOrStderr())
+	if err != nil {
+		return fmt.Errorf("failed to build image: %w", err)
+	}
+	slog.Info("Built and pushed image", slog.String("image", image), slog.String("digest", digest))
+	for _, name := range containerNames {
+		container := workload.Spec.Containers[name]
+		container.Image = image + "@" + digest
+		workload.Spec.Containers[name] = container
+	}
+	return nil
+}
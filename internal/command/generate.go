@@ -15,11 +15,16 @@
 package command
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 
 	"dario.cat/mergo"
@@ -34,6 +39,8 @@ import (
 	"github.com/astromechza/score-flyio/internal/convert"
 	"github.com/astromechza/score-flyio/internal/flymachines"
 	"github.com/astromechza/score-flyio/internal/provisioners"
+	"github.com/astromechza/score-flyio/internal/provisioners/builtin"
+	"github.com/astromechza/score-flyio/internal/registry"
 	"github.com/astromechza/score-flyio/internal/state"
 )
 
@@ -44,6 +51,12 @@ const (
 	generateCmdEnvSecretsFlag       = "secrets-file"
 	generateCmdDeployFlag           = "deploy"
 	generateCmdDeployArgsFlag       = "deploy-args"
+	generateCmdPatchFileFlag        = "patch-file"
+	generateCmdBuildFlag            = "build"
+	generateCmdBuilderFlag          = "builder"
+	generateCmdBuildRegistryFlag    = "build-registry"
+	generateCmdBuildTagFlag         = "build-tag"
+	generateCmdPinImagesFlag        = "pin-images"
 )
 
 var generateCmd = &cobra.Command{
@@ -118,18 +131,34 @@ var generateCmd = &cobra.Command{
 			}
 		}
 
-		if currentState, err = currentState.WithWorkload(&workload, &workloadFile, state.WorkloadExtras{}); err != nil {
+		workloadExtras := state.WorkloadExtras{}
+		if pin, _ := cmd.Flags().GetBool(generateCmdPinImagesFlag); pin {
+			if workloadExtras.PinnedImages, err = pinImages(cmd.Context(), registry.NewClient(), &workload); err != nil {
+				return fmt.Errorf("failed to pin images: %w", err)
+			}
+		}
+
+		if currentState, err = currentState.WithWorkload(&workload, &workloadFile, workloadExtras); err != nil {
 			return fmt.Errorf("failed to add score file to project: %s: %w", workloadFile, err)
 		}
 		slog.Info("Added score file to project", "file", workloadFile)
 
+		if mustBuild, _ := cmd.Flags().GetBool(generateCmdBuildFlag); mustBuild {
+			if err := buildWorkloadImages(cmd, currentState, workloadName); err != nil {
+				return fmt.Errorf("failed to build workload: %w", err)
+			}
+		}
+
 		if currentState, err = currentState.WithPrimedResources(); err != nil {
 			return fmt.Errorf("failed to prime resources: %w", err)
 		}
 
 		slog.Info("Primed resources", "#workloads", len(currentState.Workloads), "#resources", len(currentState.Resources))
 
-		currentState, err = provisioners.ProvisionResources(currentState)
+		currentState, err = provisioners.ProvisionResources(currentState, func(s *state.State) error {
+			sd.State = *s
+			return sd.Persist()
+		})
 		if currentState != nil {
 			sd.State = *currentState
 			if persistErr := sd.Persist(); persistErr != nil {
@@ -141,17 +170,43 @@ var generateCmd = &cobra.Command{
 			return fmt.Errorf("failed to provision resources: %w", err)
 		}
 
-		flyAppName := currentState.Extras.AppPrefix + workloadName
+		flyAppName := convert.AppName(currentState, workloadName)
 		flyAppToml := fmt.Sprintf("fly_%s.toml", workloadName)
+		groupWorkloads := []string{workloadName}
+		convertName, convertFunc := workloadName, convert.Workload
+		if appGroup := convert.AppGroup(currentState, workloadName); appGroup != "" {
+			flyAppToml = fmt.Sprintf("fly_%s.toml", appGroup)
+			groupWorkloads = convert.GroupWorkloads(currentState, appGroup)
+			convertName, convertFunc = appGroup, convert.WorkloadGroup
+			slog.Info("Workload is part of an app group, converting all workloads in the group as process groups", slog.String("group", appGroup), slog.Any("workloads", groupWorkloads))
+		}
 
-		if manifest, secrets, err := convert.Workload(currentState, workloadName); err != nil {
+		if manifest, secrets, err := convertFunc(currentState, convertName); err != nil {
 			return fmt.Errorf("failed to convert workloads: %w", err)
 		} else {
 
+			var patches []string
+			for _, name := range groupWorkloads {
+				if v := convert.WorkloadConfigPatch(currentState, name); v != "" {
+					patches = append(patches, v)
+				}
+			}
+			if v, _ := cmd.Flags().GetString(generateCmdPatchFileFlag); v != "" {
+				raw, err := os.ReadFile(v)
+				if err != nil {
+					return fmt.Errorf("--%s '%s' is invalid, failed to read file: %w", generateCmdPatchFileFlag, v, err)
+				}
+				patches = append(patches, string(raw))
+			}
+			patchedManifest, err := convert.PatchConfig(manifest, patches...)
+			if err != nil {
+				return fmt.Errorf("%s: failed to patch fly config: %w", workloadName, err)
+			}
+
 			f, err := os.CreateTemp("", "*")
 			if err != nil {
 				return fmt.Errorf("%s: failed to create tempfile: %w", workloadName, err)
-			} else if err := toml.NewEncoder(f).Encode(manifest); err != nil {
+			} else if err := toml.NewEncoder(f).Encode(patchedManifest); err != nil {
 				return fmt.Errorf("%s: failed to encode toml: %w", workloadName, err)
 			} else if err := f.Close(); err != nil {
 				return fmt.Errorf("%s: failed to close tempfile: %w", workloadName, err)
@@ -188,6 +243,34 @@ var generateCmd = &cobra.Command{
 						return fmt.Errorf("failed to create app: %w", err)
 					}
 				}
+				private, err := convert.AppPrivate(currentState, groupWorkloads)
+				if err != nil {
+					return err
+				} else if private {
+					ingress, err := flymachines.NewIngress()
+					if err != nil {
+						return fmt.Errorf("failed to setup fly api client: %w", err)
+					}
+					public, err := flymachines.EnsurePrivateIp(ingress, flyAppName)
+					if err != nil {
+						return fmt.Errorf("failed to allocate private ip: %w", err)
+					}
+					for _, ip := range public {
+						slog.Warn("App has private-only services but has a public ip, release it with 'fly ips release'", slog.String("app", flyAppName), slog.String("ip", ip.Address), slog.String("type", ip.Type))
+					}
+				}
+				for _, name := range groupWorkloads {
+					for _, dep := range builtin.WorkloadDependencies(currentState, name) {
+						depApp := convert.AppName(currentState, dep)
+						if depApp == flyAppName {
+							continue
+						} else if _, ok, err := flymachines.GetApp(client, depApp); err != nil {
+							return fmt.Errorf("failed to get app: %w", err)
+						} else if !ok {
+							slog.Warn("Workload depends on a workload that has not been deployed yet, deploy it first", slog.String("workload", name), slog.String("dependency", dep), slog.String("app", depApp))
+						}
+					}
+				}
 				if len(secrets) > 0 {
 					slog.Info("Setting secrets on app", slog.String("app", flyAppName), slog.Int("#secrets", len(secrets)))
 					args := []string{"secrets", "set", "--access-token", client.ApiToken, "--app", flyAppName, "--stage"}
@@ -203,6 +286,9 @@ var generateCmd = &cobra.Command{
 				}
 				slog.Info("Deploying to app", slog.String("app", flyAppName))
 				args = []string{"deploy", "--access-token", client.ApiToken, "--app", flyAppName, "--config", flyAppToml}
+				if private {
+					args = append(args, "--no-public-ips")
+				}
 				if deployArgs, _ := cmd.Flags().GetStringArray(generateCmdDeployArgsFlag); len(deployArgs) > 0 {
 					args = append(args, deployArgs...)
 				}
@@ -213,6 +299,16 @@ var generateCmd = &cobra.Command{
 				if err := c.Run(); err != nil {
 					return fmt.Errorf("failed to deploy: %w", err)
 				}
+				for _, name := range groupWorkloads {
+					regions, _ := convert.WorkloadRegions(currentState, name)
+					processGroup := ""
+					if convertName != workloadName {
+						processGroup = name
+					}
+					if err := scaleRegions(cmd, client, flyAppName, processGroup, regions); err != nil {
+						return fmt.Errorf("failed to scale %s: %w", name, err)
+					}
+				}
 			}
 		}
 
@@ -220,6 +316,71 @@ var generateCmd = &cobra.Command{
 	},
 }
 
+// pinImages resolves the tag of each container image to a digest. Images that are built from a Dockerfile or that
+// already contain a digest are left unchanged.
+func pinImages(ctx context.Context, client *registry.Client, workload *scoretypes.Workload) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, containerName := range slices.Sorted(maps.Keys(workload.Containers)) {
+		image := workload.Containers[containerName].Image
+		if image == "." || strings.Contains(image, "@") {
+			continue
+		}
+		ref, err := registry.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("container[%s]: %w", containerName, err)
+		}
+		digest, err := client.ResolveDigest(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("container[%s]: %w", containerName, err)
+		}
+		out[containerName] = image + "@" + digest
+		slog.Info("Pinned container image to digest", slog.String("container", containerName), slog.String("image", image), slog.String("digest", digest))
+	}
+	return out, nil
+}
+
+// scaleRegions sets the machine count in each region, grouping regions with the same count into a single command.
+// Regions that have machines but are no longer listed are scaled down to 0. The process group is only set when the
+// workload is part of an app group.
+func scaleRegions(cmd *cobra.Command, client *flymachines.FlyClient, app string, processGroup string, regions []convert.RegionCount) error {
+	if len(regions) == 0 {
+		return nil
+	}
+	current, err := flymachines.MachineRegions(client, app, cmp.Or(processGroup, "app"))
+	if err != nil {
+		return err
+	}
+	regionsByCount := make(map[int][]string)
+	for _, rc := range withUnlistedRegions(regions, current) {
+		regionsByCount[rc.Count] = append(regionsByCount[rc.Count], rc.Region)
+	}
+	for _, count := range slices.Sorted(maps.Keys(regionsByCount)) {
+		slog.Info("Scaling machines", slog.String("app", app), slog.Int("count", count), slog.Any("regions", regionsByCount[count]))
+		args := []string{"scale", "count", strconv.Itoa(count), "--access-token", client.ApiToken, "--app", app, "--region", strings.Join(regionsByCount[count], ","), "--yes"}
+		if processGroup != "" {
+			args = append(args, "--process-group", processGroup)
+		}
+		c := exec.Command("fly", args...)
+		c.Stderr = cmd.ErrOrStderr()
+		c.Stdout = cmd.OutOrStdout()
+		if err := c.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withUnlistedRegions appends a count of 0 for each current region that is not in the desired regions.
+func withUnlistedRegions(regions []convert.RegionCount, current []string) []convert.RegionCount {
+	out := slices.Clone(regions)
+	for _, region := range current {
+		if !slices.ContainsFunc(regions, func(rc convert.RegionCount) bool { return rc.Region == region }) {
+			out = append(out, convert.RegionCount{Region: region, Count: 0})
+		}
+	}
+	return out
+}
+
 func writeSecretsFile(s map[string]string, p string) error {
 	content := new(strings.Builder)
 	for s2, s3 := range s {
@@ -291,6 +452,12 @@ func init() {
 	generateCmd.Flags().StringArray(generateCmdOverridePropertyFlag, []string{}, "An optional set of path=key overrides to set or remove")
 	generateCmd.Flags().String(generateCmdImageFlag, "", "An optional container image to use for any container with image == '.'")
 	generateCmd.Flags().String(generateCmdEnvSecretsFlag, "", "An optional output file for the runtime secrets in KEY=VALUE format")
+	generateCmd.Flags().String(generateCmdPatchFileFlag, "", "An optional JSON Merge Patch or JSON Patch file to apply to the generated Fly config")
+	generateCmd.Flags().Bool(generateCmdBuildFlag, false, "Build and push the Dockerfile for containers with image '.' instead of relying on Fly remote builders")
+	generateCmd.Flags().String(generateCmdBuilderFlag, "docker", "The builder to use with --build: docker, buildkit, or cmd:<binary> for an external command")
+	generateCmd.Flags().String(generateCmdBuildRegistryFlag, flyRegistry, "The registry to push images built with --build to, the repository is the app name")
+	generateCmd.Flags().String(generateCmdBuildTagFlag, "", "The tag for images built with --build, defaults to a timestamp")
+	generateCmd.Flags().Bool(generateCmdPinImagesFlag, false, "Resolve container image tags to digests through the registry and use the digests in the Fly config")
 	generateCmd.Flags().Bool(generateCmdDeployFlag, false, "Deploy the Fly app and secrets after generating the manifests")
 	generateCmd.Flags().StringArray(generateCmdDeployArgsFlag, []string{}, "Provide space-separated CLI arguments for customizing --deploy")
 	rootCmd.AddCommand(generateCmd)
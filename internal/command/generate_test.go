@@ -17,6 +17,10 @@ package command
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,6 +28,12 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/astromechza/score-flyio/internal/convert"
+	"github.com/astromechza/score-flyio/internal/flymachines"
+	"github.com/astromechza/score-flyio/internal/provisioners"
+	"github.com/astromechza/score-flyio/internal/provisioners/builtin"
+	"github.com/astromechza/score-flyio/internal/state"
 )
 
 func changeToDir(t *testing.T, dir string) string {
@@ -102,7 +112,7 @@ resources:
 	require.EqualError(t, err, "failed to provision resources: failed to find a provisioner for 'swamp.default#example.thing'")
 	stdout, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"resources", "list"})
 	assert.NoError(t, err)
-	assert.Equal(t, "uid source_workload provisioner outputs \n", stdout)
+	assert.Equal(t, "uid source_workload provisioner outputs missing_outputs \n", stdout)
 }
 
 func TestSampleTests(t *testing.T) {
@@ -133,3 +143,1085 @@ func TestSampleTests(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateWithPatchFile(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/fly-config-patch: '{"env":{"FROM_ANNOTATION":"yes"}}'
+containers:
+  main:
+    image: nginx
+    variables:
+      A: a
+      B: b
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "patch.json"), []byte(`[
+  {"op": "remove", "path": "/env/A"},
+  {"op": "add", "path": "/mounts", "value": [{"source": "data", "destination": "/data"}]},
+  {"op": "add", "path": "/mounts/-", "value": {"source": "other", "destination": "/other"}},
+  {"op": "test", "path": "/env/FROM_ANNOTATION", "value": "yes"}
+]`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml", "--patch-file", "patch.json"})
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, `app = "exampleexample"
+
+[build]
+  image = "nginx"
+
+[env]
+  B = "b"
+  FROM_ANNOTATION = "yes"
+
+[[mounts]]
+  destination = "/data"
+  source = "data"
+
+[[mounts]]
+  destination = "/other"
+  source = "other"
+`, string(raw))
+
+	require.NoError(t, os.WriteFile(filepath.Join(td, "patch.json"), []byte(`[{"op": "replace", "path": "/unknown", "value": 1}]`), 0644))
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml", "--patch-file", "patch.json"})
+	assert.EqualError(t, err, "example: failed to patch fly config: patch 1: failed to apply json patch: operation 0: key 'unknown' not found")
+}
+
+func TestGenerateWithSecretInReleaseCommand(t *testing.T) {
+	td := changeToTempDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"values":{"host":"db;id"},"secrets":{"password":"p'w"}}`))
+	}))
+	defer srv.Close()
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/deploy-release-command: "migrate --host ${resources.db.host} --password ${resources.db.password}"
+containers:
+  main:
+    image: nginx
+resources:
+  db:
+    type: postgres
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "pg", "postgres", "--http-url", srv.URL})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml", "--secrets-file", "secrets.env"})
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `
+[deploy]
+  release_command = "/bin/sh -c 'migrate --host '\"'\"'db;id'\"'\"' --password \"${RELEASE_COMMAND_SECRET_0}\"'"
+`)
+	raw, err = os.ReadFile(filepath.Join(td, "secrets.env"))
+	require.NoError(t, err)
+	assert.Equal(t, "RELEASE_COMMAND_SECRET_0=p'w\n", string(raw))
+}
+
+func TestGenerateWithInvalidDeployStrategy(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/deploy-strategy: "bluegreen"
+containers:
+  main:
+    image: nginx
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: deploy: the bluegreen strategy requires a liveness or readiness probe")
+}
+
+func TestGenerateWithContradictingSharedPortAnnotations(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/service-http-min-running: "1"
+    score-flyio.astromechza.github.com/service-https-min-running: "2"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    http:
+      port: 80
+      targetPort: 8080
+    https:
+      port: 443
+      targetPort: 8080
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: services[https]: min-running '2' contradicts '1' on port 'http' which shares the same target port")
+}
+
+func TestGenerateWithInvalidAnnotations(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/service-web-admin-handlers: "http"
+    score-flyio.astromechza.github.com/service-web-admin-auto-stop: "yes"
+    score-flyio.astromechza.github.com/service-web-admin-min-running: "-1"
+    score-flyio.astromechza.github.com/service-other-handlers: "http"
+    score-flyio.astromechza.github.com/unknown: "x"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    web-admin:
+      port: 80
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, `failed to convert workloads: annotations: annotation 'score-flyio.astromechza.github.com/service-other-handlers': service port 'other' does not exist
+annotation 'score-flyio.astromechza.github.com/service-web-admin-auto-stop': 'yes' is not one of [off stop suspend]
+annotation 'score-flyio.astromechza.github.com/service-web-admin-min-running': '-1' must be at least 0
+unrecognised score-flyio.astromechza.github.com/ annotation: 'score-flyio.astromechza.github.com/unknown'`)
+}
+
+func TestGenerateWithConflictingVmSize(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/vm-size: "shared-cpu-2x"
+containers:
+  main:
+    image: nginx
+    resources:
+      limits:
+        memory: "5G"
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: resources: vm size 'shared-cpu-2x' allows at most 4096MB memory but 5000MB was requested")
+}
+
+func TestGenerateWithInvalidCheckTiming(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/liveness-interval: "10s"
+    score-flyio.astromechza.github.com/liveness-timeout: "20s"
+containers:
+  main:
+    image: nginx
+    livenessProbe:
+      httpGet:
+        port: 8080
+        path: /livez
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: container[main].livenessProbe: timeout '20s' must not be longer than the interval '10s'")
+}
+
+func TestGenerateWithExecProbeShimWithoutCommand(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/exec-probe-strategy: "shim"
+containers:
+  main:
+    image: nginx
+    livenessProbe:
+      exec:
+        command: ["true"]
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: container[main]: the shim exec probe strategy requires the container command to be set")
+}
+
+func TestGenerateWithUnknownMetricsPort(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/metrics-port: "9091"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    web:
+      port: 80
+      targetPort: 8080
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: metrics: port 9091 does not match the target port of any service port")
+}
+
+func TestGenerateWithMetricsOnServicePort(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/metrics-port: "8080"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    web:
+      port: 80
+      targetPort: 8080
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, `app = "exampleexample"
+
+[build]
+  image = "nginx"
+
+[[metrics]]
+  path = "/metrics"
+  port = 8080
+
+[[services]]
+  internal_port = 8080
+  min_machines_running = 0
+  protocol = "tcp"
+
+  [[services.ports]]
+    port = 80
+`, string(raw))
+}
+
+func TestGenerateWithStaticsInsideVolume(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/statics: '[{"guest_path": "/data/public", "url_prefix": "/"}]'
+containers:
+  main:
+    image: nginx
+    volumes:
+      - source: data
+        target: /data
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: statics[0]: guest_path '/data/public' is inside volume '/data' but statics are served from the image")
+}
+
+func TestGenerateWithRestartRetriesWithoutOnFailure(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/restart-policy: "always"
+    score-flyio.astromechza.github.com/restart-retries: "3"
+containers:
+  main:
+    image: nginx
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: restart retries can only be set with the on-failure restart policy")
+}
+
+func TestGenerateWithVolumeSettingsFromResource(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/volume-data-snapshot-retention: "7"
+containers:
+  main:
+    image: nginx
+    volumes:
+      - source: ${resources.vol.source}
+        target: /data
+resources:
+  vol:
+    type: volume
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "volume", "volume", "--static-json", `{"source":"example_data","initial_size":"20gb","snapshot_retention":30}`})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `[[mounts]]
+  destination = "/data"
+  initial_size = "20gb"
+  snapshot_retention = 7
+  source = "example_data"
+`)
+}
+
+func TestGenerateWithAmbiguousVolumeSettings(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/volume-a-b-initial-size: 10gb
+containers:
+  main:
+    image: nginx
+    volumes:
+      - source: one
+        target: /a-b
+      - source: two
+        target: /a/b
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: annotations: volume targets '/a-b' and '/a/b' have the same key 'a-b' so their volume annotations are ambiguous")
+}
+
+func TestGenerateWithSharedMountVolumeSettings(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/init-shim: "true"
+    score-flyio.astromechza.github.com/volume-etc-app-config-initial-size: 10gb
+containers:
+  main:
+    image: nginx
+    command: ["nginx"]
+    volumes:
+      - source: data
+        target: /var/lib/app
+        path: app
+      - source: data
+        target: /etc/app/config
+        path: config
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: container[main].volumes[1]: volume annotations for 'etc-app-config' cannot be applied since the mount of source 'data' is shared with an earlier volume, set them for the first volume target instead")
+}
+
+func TestGenerateWithForceHttpsOnRawServices(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/service-api-force-https: "true"
+    score-flyio.astromechza.github.com/service-web-force-https: "true"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    web:
+      port: 443
+      targetPort: 8080
+    api:
+      port: 9443
+      targetPort: 9090
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	// the first port name in sorted order is always reported
+	for range 5 {
+		_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+		assert.EqualError(t, err, "failed to convert workloads: services[api]: force-https can only be used when the port is converted into an http_service")
+	}
+}
+
+func TestGenerateWithFileModeWithoutInitShim(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+containers:
+  main:
+    image: nginx
+    files:
+      - target: /etc/script.sh
+        mode: "0755"
+        content: "echo hello"
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: container[main].files[0]: mode not supported without the init-shim annotation")
+}
+
+func TestGenerateWithInitShimWithoutCommand(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/init-shim: "true"
+containers:
+  main:
+    image: nginx
+    volumes:
+      - source: data
+        target: /data
+        readOnly: true
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: container[main]: the init shim requires the container command to be set")
+}
+
+func TestGenerateWithInvalidRegions(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/regions: "lhr=2,lhr"
+containers:
+  main:
+    image: nginx
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: annotation 'score-flyio.astromechza.github.com/regions': region 'lhr' is listed more than once")
+}
+
+func TestGenerateWithServiceResource(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "backend.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: backend
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    api:
+      port: 80
+      targetPort: 8080
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "worker.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: worker
+containers:
+  main:
+    image: nginx
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "admin.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: admin
+  annotations:
+    score-flyio.astromechza.github.com/service-web-private: "true"
+    score-flyio.astromechza.github.com/service-web-http: "true"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    web:
+      port: 3000
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "frontend.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: frontend
+containers:
+  main:
+    image: nginx
+    variables:
+      BACKEND_URL: http://${resources.backend.ports.api.host}:${resources.backend.ports.api.port}
+      WORKER_HOST: ${resources.jobs.host}
+      ADMIN_URL: http://${resources.admin.host}:${resources.admin.port}
+resources:
+  admin:
+    type: service
+  backend:
+    type: service
+  jobs:
+    type: service
+    params:
+      workload: worker
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+	require.NoError(t, err)
+
+	// the target workloads must be generated first
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "frontend.yaml"})
+	if assert.Error(t, err) {
+		assert.Regexp(t, `invalid ref 'resources\.(backend\.ports\.api\.host|admin\.port)': key 'ports?' not found`, err.Error())
+	}
+
+	for _, f := range []string{"backend.yaml", "worker.yaml", "admin.yaml", "frontend.yaml"} {
+		_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", f})
+		require.NoError(t, err)
+	}
+	raw, err := os.ReadFile(filepath.Join(td, "fly_frontend.toml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `BACKEND_URL = "http://example-backend.internal:8080"`)
+	assert.Contains(t, string(raw), `ADMIN_URL = "http://example-admin.flycast:80"`)
+	assert.Contains(t, string(raw), `WORKER_HOST = "example-worker.internal"`)
+
+	sd, ok, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []string{"admin", "backend", "worker"}, builtin.WorkloadDependencies(&sd.State, "frontend"))
+}
+
+type fakeIngress struct {
+	calls          []string
+	ips            []flymachines.IpAddress
+	certificateErr error
+}
+
+func (f *fakeIngress) ListIps(app string) ([]flymachines.IpAddress, error) {
+	f.calls = append(f.calls, "list-ips "+app)
+	return f.ips, nil
+}
+
+func (f *fakeIngress) EnsureApp(app string) error {
+	f.calls = append(f.calls, "ensure-app "+app)
+	return nil
+}
+
+func (f *fakeIngress) AllocateIp(app string, ipType string) (*flymachines.IpAddress, error) {
+	f.calls = append(f.calls, "allocate-ip "+app+" "+ipType)
+	if ipType == flymachines.IpTypeV6 {
+		return &flymachines.IpAddress{Address: "2a09:8280:1::1", Type: ipType}, nil
+	}
+	return &flymachines.IpAddress{Address: "66.241.124.1", Type: ipType}, nil
+}
+
+func (f *fakeIngress) ReleaseIp(app string, address string) error {
+	f.calls = append(f.calls, "release-ip "+app+" "+address)
+	return nil
+}
+
+func (f *fakeIngress) AddCertificate(app string, hostname string) (*flymachines.Certificate, error) {
+	f.calls = append(f.calls, "add-certificate "+app+" "+hostname)
+	if f.certificateErr != nil {
+		return nil, f.certificateErr
+	}
+	return &flymachines.Certificate{Hostname: hostname, DnsValidationHostname: "_acme-challenge." + hostname, DnsValidationTarget: hostname + ".x1y2.flydns.net"}, nil
+}
+
+func (f *fakeIngress) DeleteCertificate(app string, hostname string) error {
+	f.calls = append(f.calls, "delete-certificate "+app+" "+hostname)
+	return nil
+}
+
+func TestGenerateWithDnsResource(t *testing.T) {
+	fake := &fakeIngress{}
+	previous := provisioners.RegisterBuiltinProvisioner(builtin.DnsResourceType, builtin.NewDnsProvisioner(func() (flymachines.Ingress, error) {
+		return fake, nil
+	}))
+	t.Cleanup(func() {
+		provisioners.RegisterBuiltinProvisioner(builtin.DnsResourceType, previous)
+	})
+
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+containers:
+  main:
+    image: nginx
+    variables:
+      PUBLIC_URL: https://${resources.dns.host}
+      PUBLIC_IP: ${resources.dns.ipv6}
+resources:
+  dns:
+    type: dns
+    params:
+      host: www.example.com
+      ip: dedicated
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+	// the outputs are reused while the params are unchanged
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"ensure-app example-example",
+		"allocate-ip example-example v4",
+		"allocate-ip example-example v6",
+		"add-certificate example-example www.example.com",
+	}, fake.calls)
+
+	raw, err := os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `PUBLIC_URL = "https://www.example.com"`)
+	assert.Contains(t, string(raw), `PUBLIC_IP = "2a09:8280:1::1"`)
+
+	sd, ok, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"type": "A", "name": "www.example.com", "value": "66.241.124.1"},
+		map[string]interface{}{"type": "AAAA", "name": "www.example.com", "value": "2a09:8280:1::1"},
+		map[string]interface{}{"type": "CNAME", "name": "_acme-challenge.www.example.com", "value": "www.example.com.x1y2.flydns.net"},
+	}, sd.State.Resources["dns.default#example.dns"].Outputs["records"])
+
+	fake.calls = nil
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"resources", "deprovision", "dns.default#example.dns"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"delete-certificate example-example www.example.com",
+		"release-ip example-example 66.241.124.1",
+		"release-ip example-example 2a09:8280:1::1",
+	}, fake.calls)
+}
+
+func TestGenerateWithDnsResourceSharedIp(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ips      []flymachines.IpAddress
+		expected []string
+	}{
+		{
+			name: "allocated",
+			expected: []string{
+				"ensure-app example-example",
+				"list-ips example-example",
+				"allocate-ip example-example shared_v4",
+				"release-ip example-example 66.241.124.1",
+			},
+		},
+		{
+			// the shared ip was allocated before, for example by fly deploy, so it must be kept
+			name: "existing",
+			ips:  []flymachines.IpAddress{{Address: "66.241.124.2", Type: flymachines.IpTypeSharedV4}},
+			expected: []string{
+				"ensure-app example-example",
+				"list-ips example-example",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeIngress{ips: tc.ips}
+			previous := provisioners.RegisterBuiltinProvisioner(builtin.DnsResourceType, builtin.NewDnsProvisioner(func() (flymachines.Ingress, error) {
+				return fake, nil
+			}))
+			t.Cleanup(func() {
+				provisioners.RegisterBuiltinProvisioner(builtin.DnsResourceType, previous)
+			})
+
+			td := changeToTempDir(t)
+			require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+containers:
+  main:
+    image: nginx
+resources:
+  dns:
+    type: dns
+`), 0644))
+			_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+			require.NoError(t, err)
+			_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+			require.NoError(t, err)
+			_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"resources", "deprovision", "dns.default#example.dns"})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, fake.calls)
+		})
+	}
+}
+
+func TestGenerateWithDnsResourceFailure(t *testing.T) {
+	fake := &fakeIngress{certificateErr: errors.New("hostname is invalid")}
+	previous := provisioners.RegisterBuiltinProvisioner(builtin.DnsResourceType, builtin.NewDnsProvisioner(func() (flymachines.Ingress, error) {
+		return fake, nil
+	}))
+	t.Cleanup(func() {
+		provisioners.RegisterBuiltinProvisioner(builtin.DnsResourceType, previous)
+	})
+
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+containers:
+  main:
+    image: nginx
+resources:
+  dns:
+    type: dns
+    params:
+      host: www.example.com
+      ip: dedicated
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.ErrorContains(t, err, "hostname is invalid")
+	// the ips allocated before the failure are released again
+	assert.Equal(t, []string{
+		"ensure-app example-example",
+		"allocate-ip example-example v4",
+		"allocate-ip example-example v6",
+		"add-certificate example-example www.example.com",
+		"release-ip example-example 66.241.124.1",
+		"release-ip example-example 2a09:8280:1::1",
+	}, fake.calls)
+}
+
+func TestGenerateWithMixedPrivateServices(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/service-web-private: "false"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    api:
+      port: 8080
+    web:
+      port: 80
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file=", "--private-services"})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: service ports 'example.api' and 'example.web' mix private and public services, but ips are allocated per app")
+}
+
+func TestEnsurePrivateIp(t *testing.T) {
+	fake := &fakeIngress{ips: []flymachines.IpAddress{{Address: "66.241.124.1", Type: flymachines.IpTypeSharedV4}}}
+	public, err := flymachines.EnsurePrivateIp(fake, "example")
+	require.NoError(t, err)
+	assert.Equal(t, []flymachines.IpAddress{{Address: "66.241.124.1", Type: flymachines.IpTypeSharedV4}}, public)
+	assert.Equal(t, []string{"list-ips example", "allocate-ip example private_v6"}, fake.calls)
+
+	fake = &fakeIngress{ips: []flymachines.IpAddress{{Address: "fdaa:0:1::2", Type: flymachines.IpTypePrivateV6}}}
+	public, err = flymachines.EnsurePrivateIp(fake, "example")
+	require.NoError(t, err)
+	assert.Empty(t, public)
+	assert.Equal(t, []string{"list-ips example"}, fake.calls)
+}
+
+func TestGenerateWithExternalBuilder(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/build-args: '{"VERSION": "1.2.3"}'
+    score-flyio.astromechza.github.com/build-target: runtime
+    score-flyio.astromechza.github.com/build-secrets: '{"npmrc": "env:NPM_TOKEN"}'
+containers:
+  main:
+    image: .
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "build.sh"), []byte(`#!/bin/sh
+echo "$SCORE_BUILD_IMAGE $SCORE_BUILD_TARGET $SCORE_BUILD_ARGS $SCORE_BUILD_SECRETS" > build.log
+echo "building..."
+echo "sha256:4a8d5e1c0b6f7a2d9e3c1b0a8f7e6d5c4b3a29180f7e6d5c4b3a2918a7b6c5d4"
+`), 0755))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{
+		"generate", "score.yaml", "--build", "--builder=cmd:" + filepath.Join(td, "build.sh"),
+		"--build-registry=registry.example.com", "--build-tag=v1",
+	})
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(td, "build.log"))
+	require.NoError(t, err)
+	assert.Equal(t, `registry.example.com/example-example:v1 runtime {"VERSION":"1.2.3"} {"npmrc":"env:NPM_TOKEN"}`+"\n", string(raw))
+	raw, err = os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, `app = "example-example"
+
+[build]
+  image = "registry.example.com/example-example:v1@sha256:4a8d5e1c0b6f7a2d9e3c1b0a8f7e6d5c4b3a29180f7e6d5c4b3a2918a7b6c5d4"
+`, string(raw))
+}
+
+func TestGenerateWithBuildInAppGroup(t *testing.T) {
+	td := changeToTempDir(t)
+	for _, name := range []string{"web", "worker"} {
+		require.NoError(t, os.WriteFile(filepath.Join(td, name+".yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: `+name+`
+  annotations:
+    score-flyio.astromechza.github.com/app-group: shop
+containers:
+  main:
+    image: .
+    args: ["`+name+`"]
+`), 0644))
+	}
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "worker.yaml"})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "web.yaml", "--build", "--builder=cmd:false", "--build-registry=registry.example.com"})
+	assert.EqualError(t, err, "failed to build workload: cannot build workloads in app group 'shop' since all workloads in the group must share an image, build and push the image separately instead")
+}
+
+func TestGenerateWithPinImages(t *testing.T) {
+	digest := "sha256:0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	var svr *httptest.Server
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" || r.URL.Query().Get("scope") != "repository:demo/app:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token": "tok"}`))
+		case "/v2/demo/app/manifests/v1":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+svr.URL+`/token",service="test",scope="repository:demo/app:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	registryHost := strings.TrimPrefix(svr.URL, "http://")
+
+	td := changeToTempDir(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(td, "docker"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "docker", "config.json"), []byte(`{"auths": {"`+registryHost+`": {"auth": "dXNlcjpwYXNz"}}}`), 0600))
+	t.Setenv("DOCKER_CONFIG", filepath.Join(td, "docker"))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+containers:
+  main:
+    image: `+registryHost+`/demo/app:v1
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml", "--pin-images"})
+	require.NoError(t, err)
+
+	pinned := registryHost + "/demo/app:v1@" + digest
+	raw, err := os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `image = "`+pinned+`"`)
+	sd, ok, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"main": pinned}, sd.State.Workloads["example"].Extras.PinnedImages)
+}
+
+func TestGenerateWithNonStandardHttpPort(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+  annotations:
+    score-flyio.astromechza.github.com/service-web-handlers: "http"
+containers:
+  main:
+    image: nginx
+service:
+  ports:
+    web:
+      port: 3000
+      targetPort: 8080
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(td, "fly_example.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, `app = "exampleexample"
+
+[build]
+  image = "nginx"
+
+[[services]]
+  internal_port = 8080
+  min_machines_running = 0
+  protocol = "tcp"
+
+  [[services.ports]]
+    handlers = ["http"]
+    port = 3000
+`, string(raw))
+}
+
+func TestWithUnlistedRegions(t *testing.T) {
+	assert.Equal(t, []convert.RegionCount{
+		{Region: "lhr", Count: 2}, {Region: "ams", Count: 1}, {Region: "fra", Count: 0},
+	}, withUnlistedRegions([]convert.RegionCount{{Region: "lhr", Count: 2}, {Region: "ams", Count: 1}}, []string{"ams", "fra", "lhr"}))
+}
+
+func TestAnnotationsSchema(t *testing.T) {
+	stdout, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"annotations", "schema"})
+	require.NoError(t, err)
+	var schema map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &schema))
+	assert.Contains(t, schema["properties"], "score-flyio.astromechza.github.com/deploy-strategy")
+	assert.Contains(t, schema["patternProperties"], `^score-flyio\.astromechza\.github\.com/service-.+-handlers$`)
+}
+
+func TestGenerateWithAppGroup(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "web.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: web
+  annotations:
+    score-flyio.astromechza.github.com/app-group: shop
+containers:
+  main:
+    image: ghcr.io/example/shop:v1
+    args: ["serve", "--port", "8080"]
+    variables:
+      SHARED: "yes"
+    resources:
+      limits:
+        memory: 512M
+    livenessProbe:
+      httpGet:
+        port: 8080
+        path: /livez
+service:
+  ports:
+    web:
+      port: 80
+      targetPort: 8080
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(td, "worker.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: worker
+  annotations:
+    score-flyio.astromechza.github.com/app-group: shop
+containers:
+  main:
+    image: ghcr.io/example/shop:v1
+    args: ["work", "--queue", "default queue"]
+    variables:
+      SHARED: "yes"
+    volumes:
+    - source: data
+      target: /data
+`), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example-", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "web.yaml"})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "worker.yaml"})
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(td, "fly_shop.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, `app = "example-shop"
+
+[build]
+  image = "ghcr.io/example/shop:v1"
+
+[checks]
+  [checks.web_liveness_probe]
+    method = "get"
+    path = "/livez"
+    port = 8080
+    processes = ["web"]
+    type = "http"
+
+[env]
+  SHARED = "yes"
+
+[[mounts]]
+  destination = "/data"
+  processes = ["worker"]
+  source = "data"
+
+[processes]
+  web = "serve --port 8080"
+  worker = "work --queue 'default queue'"
+
+[[services]]
+  internal_port = 8080
+  min_machines_running = 0
+  processes = ["web"]
+  protocol = "tcp"
+
+  [[services.ports]]
+    port = 80
+
+[[vm]]
+  cpu_kind = "shared"
+  cpus = 1
+  memory = "512MB"
+  processes = ["web"]
+  size = "shared-cpu-1x"
+`, string(raw))
+
+	require.NoError(t, os.WriteFile(filepath.Join(td, "worker.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: worker
+  annotations:
+    score-flyio.astromechza.github.com/app-group: shop
+containers:
+  main:
+    image: ghcr.io/example/shop:v2
+`), 0644))
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "worker.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: workloads 'web' and 'worker' in app group 'shop' have conflicting images")
+
+	require.NoError(t, os.WriteFile(filepath.Join(td, "worker.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: worker
+  annotations:
+    score-flyio.astromechza.github.com/app-group: shop
+containers:
+  main:
+    image: ghcr.io/example/shop:v1
+`), 0644))
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "worker.yaml"})
+	assert.EqualError(t, err, "failed to convert workloads: workload 'worker' in app group 'shop' has no container args, but each process group requires a command")
+}
@@ -25,12 +25,15 @@ import (
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 
+	"github.com/astromechza/score-flyio/internal/convert"
 	"github.com/astromechza/score-flyio/internal/state"
 )
 
 const (
 	initCmdFileFlag      = "file"
 	initCmdAppPrefixFlag = "fly-app-prefix"
+	initCmdRegionFlag    = "fly-region"
+	initCmdPrivateFlag   = "private-services"
 )
 
 var initCmd = &cobra.Command{
@@ -43,6 +46,9 @@ var initCmd = &cobra.Command{
 	SilenceErrors: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cmd.SilenceUsage = true
+		if region, _ := cmd.Flags().GetString(initCmdRegionFlag); region != "" && !convert.IsRegion(region) {
+			return fmt.Errorf("--%s '%s' is not a 3 letter Fly region code", initCmdRegionFlag, region)
+		}
 		sd, ok, err := state.LoadStateDirectory(".")
 		if err != nil {
 			return fmt.Errorf("failed to load existing state directory: %w", err)
@@ -52,20 +58,43 @@ var initCmd = &cobra.Command{
 			if pref != "" && pref != sd.State.Extras.AppPrefix {
 				return fmt.Errorf("--%s cannot be changed after first init ('%s' != '%s')", initCmdAppPrefixFlag, pref, sd.State.Extras.AppPrefix)
 			}
+			if private, _ := cmd.Flags().GetBool(initCmdPrivateFlag); cmd.Flags().Lookup(initCmdPrivateFlag).Changed && private != sd.State.Extras.PrivateServices {
+				slog.Info("Updating private services default", slog.Bool("private", private))
+				sd.State.Extras.PrivateServices = private
+				if err := sd.Persist(); err != nil {
+					return fmt.Errorf("failed to persist state directory: %w", err)
+				}
+			}
+			if region, _ := cmd.Flags().GetString(initCmdRegionFlag); region != "" && region != sd.State.Extras.PrimaryRegion {
+				slog.Info("Updating primary region", slog.String("region", region), slog.String("previous", sd.State.Extras.PrimaryRegion))
+				sd.State.Extras.PrimaryRegion = region
+				if sd.State.SharedState == nil {
+					sd.State.SharedState = make(map[string]interface{})
+				}
+				sd.State.SharedState[state.SharedStateRegionKey] = region
+				if err := sd.Persist(); err != nil {
+					return fmt.Errorf("failed to persist state directory: %w", err)
+				}
+			}
 		} else {
 			if !cmd.Flags().Lookup(initCmdAppPrefixFlag).Changed {
 				return fmt.Errorf("--%s must be set on first init", initCmdAppPrefixFlag)
 			}
 			pref, _ := cmd.Flags().GetString(initCmdAppPrefixFlag)
+			region, _ := cmd.Flags().GetString(initCmdRegionFlag)
+			private, _ := cmd.Flags().GetBool(initCmdPrivateFlag)
 			sd = &state.StateDirectory{
 				Path: state.DefaultRelativeStateDirectory,
 				State: state.State{
-					Extras:      state.StateExtras{AppPrefix: pref},
+					Extras:      state.StateExtras{AppPrefix: pref, PrimaryRegion: region, PrivateServices: private},
 					Workloads:   map[string]framework.ScoreWorkloadState[state.WorkloadExtras]{},
 					Resources:   map[framework.ResourceUid]framework.ScoreResourceState[state.ResourceExtras]{},
 					SharedState: map[string]interface{}{state.SharedStateAppPrefixKey: pref},
 				},
 			}
+			if region != "" {
+				sd.State.SharedState[state.SharedStateRegionKey] = region
+			}
 			slog.Info("Writing new state directory", "dir", sd.Path)
 			if err := sd.Persist(); err != nil {
 				return fmt.Errorf("failed to persist new state directory: %w", err)
@@ -113,5 +142,7 @@ var initCmd = &cobra.Command{
 func init() {
 	initCmd.Flags().StringP(initCmdFileFlag, "f", "score.yaml", "The score file to initialize")
 	initCmd.Flags().String(initCmdAppPrefixFlag, "", "A prefix to add to Workload names to determine final Fly.io app names")
+	initCmd.Flags().String(initCmdRegionFlag, "", "The primary Fly.io region for apps and provisioned resources, this can be changed by running init again")
+	initCmd.Flags().Bool(initCmdPrivateFlag, false, "Make service ports private-only by default so that they are only reachable through a Flycast private ip")
 	rootCmd.AddCommand(initCmd)
 }
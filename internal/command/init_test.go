@@ -91,3 +91,35 @@ func TestInitNominal_run_twice(t *testing.T) {
 		assert.Equal(t, map[string]interface{}{state.SharedStateAppPrefixKey: "example"}, sd.State.SharedState)
 	}
 }
+
+func TestInitWithRegion(t *testing.T) {
+	td := t.TempDir()
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(td))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--fly-region=London"})
+	assert.EqualError(t, err, "--fly-region 'London' is not a 3 letter Fly region code")
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--fly-region=lhr"})
+	require.NoError(t, err)
+
+	// the region can be changed on subsequent inits
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-region=ams"})
+	require.NoError(t, err)
+
+	sd, ok, err := state.LoadStateDirectory(".")
+	assert.NoError(t, err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "ams", sd.State.Extras.PrimaryRegion)
+		assert.Equal(t, map[string]interface{}{state.SharedStateAppPrefixKey: "example", state.SharedStateRegionKey: "ams"}, sd.State.SharedState)
+	}
+
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+	raw, err := os.ReadFile("fly_example.toml")
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `primary_region = "ams"`)
+}
@@ -4,14 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/url"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
 
+	scoretypes "github.com/score-spec/score-go/types"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 
+	"github.com/astromechza/score-flyio/internal/provisioners"
 	"github.com/astromechza/score-flyio/internal/state"
 )
 
@@ -22,8 +27,44 @@ const (
 	addProvCmdBinFlag     = "cmd-binary"
 	addProvCmdBinArgsFlag = "cmd-args"
 	addProvHttpUrlFlag    = "http-url"
+	addProvHttpPollFlag   = "http-poll-timeout"
+	addProvResAnnotFlag   = "res-annotation"
+	addProvFallbackFlag   = "fallback"
+	addProvBeforeFlag     = "before"
+	addProvAfterFlag      = "after"
+	addProvReplaceFlag    = "replace"
+	addProvExpValuesFlag  = "expect-values"
+	addProvExpSecretsFlag = "expect-secrets"
+
+	testProvTypeFlag   = "type"
+	testProvClassFlag  = "class"
+	testProvIdFlag     = "id"
+	testProvParamsFlag = "params"
+	testProvMetaFlag   = "metadata"
 )
 
+// insertProvisioner inserts the provisioner before or after the provisioner with the given id, or at the top of the list
+// if neither is set.
+func insertProvisioner(provisioners []state.Provisioner, p state.Provisioner, before, after string) ([]state.Provisioner, error) {
+	if before != "" && after != "" {
+		return nil, fmt.Errorf("only one of --%s or --%s can be set", addProvBeforeFlag, addProvAfterFlag)
+	}
+	index := 0
+	if ref := before + after; ref != "" {
+		i := slices.IndexFunc(provisioners, func(provisioner state.Provisioner) bool {
+			return provisioner.ProvisionerId == ref
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("no provisioner with id '%s'", ref)
+		}
+		index = i
+		if after != "" {
+			index++
+		}
+	}
+	return slices.Insert(provisioners, index, p), nil
+}
+
 var (
 	provisionersGroup = &cobra.Command{
 		Use: "provisioners",
@@ -50,7 +91,18 @@ var (
 				} else if provisioner.Static != nil {
 					t = fmt.Sprintf("Static #%d", len(*provisioner.Static))
 				}
-				fmt.Printf("[%d]: %s (%s.%s#%s) %s\n", i, provisioner.ProvisionerId, provisioner.ResourceType, provisioner.ResourceClass, provisioner.ResourceId, t)
+				for _, k := range slices.Sorted(maps.Keys(provisioner.ResourceAnnotations)) {
+					t += fmt.Sprintf(" %s=%s", k, provisioner.ResourceAnnotations[k])
+				}
+				if provisioner.Fallback {
+					t += " (fallback)"
+				}
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "[%d]: %s (%s.%s#%s) %s\n", i, provisioner.ProvisionerId, provisioner.ResourceType, provisioner.ResourceClass, provisioner.ResourceId, t)
+				for _, uid := range slices.Sorted(maps.Keys(sd.State.Resources)) {
+					if sd.State.Resources[uid].ProvisionerUri == provisioner.ProvisionerId {
+						_, _ = fmt.Fprintf(cmd.OutOrStdout(), "    serves: %s\n", uid)
+					}
+				}
 			}
 			return nil
 		},
@@ -74,6 +126,26 @@ var (
 			}
 			newProv.ResourceClass, _ = cmd.Flags().GetString(addProvResClassFlag)
 			newProv.ResourceId, _ = cmd.Flags().GetString(addProvResIdFlag)
+			newProv.Fallback, _ = cmd.Flags().GetBool(addProvFallbackFlag)
+			newProv.ExpectedValues, _ = cmd.Flags().GetStringSlice(addProvExpValuesFlag)
+			newProv.ExpectedSecrets, _ = cmd.Flags().GetStringSlice(addProvExpSecretsFlag)
+			for _, pattern := range []string{newProv.ResourceType, newProv.ResourceClass, newProv.ResourceId} {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid glob pattern '%s': %w", pattern, err)
+				}
+			}
+			if annotations, _ := cmd.Flags().GetStringArray(addProvResAnnotFlag); len(annotations) > 0 {
+				newProv.ResourceAnnotations = make(map[string]string, len(annotations))
+				for _, a := range annotations {
+					k, v, ok := strings.Cut(a, "=")
+					if !ok || k == "" {
+						return fmt.Errorf("--%s '%s' is invalid, expected a =-separated key and pattern", addProvResAnnotFlag, a)
+					} else if _, err := path.Match(v, ""); err != nil {
+						return fmt.Errorf("--%s '%s' is invalid glob pattern: %w", addProvResAnnotFlag, a, err)
+					}
+					newProv.ResourceAnnotations[k] = v
+				}
+			}
 
 			if b, _ := cmd.Flags().GetString(addProvCmdBinFlag); b != "" {
 				if !strings.HasPrefix(b, "/") {
@@ -92,6 +164,9 @@ var (
 					return fmt.Errorf("invalid url '%s' for an http provisioner", u)
 				}
 				newProv.Http = &state.HttpProvisioner{Url: u}
+				if pt, _ := cmd.Flags().GetDuration(addProvHttpPollFlag); pt > 0 {
+					newProv.Http.PollTimeout = pt.String()
+				}
 			} else if r, _ := cmd.Flags().GetString(addProvCmdStaticFlag); r != "" {
 				var o map[string]interface{}
 				if err = json.Unmarshal([]byte(r), &o); err != nil {
@@ -102,19 +177,77 @@ var (
 				return fmt.Errorf("expected either --%s, --%s, or --%s", addProvHttpUrlFlag, addProvCmdBinFlag, addProvCmdStaticFlag)
 			}
 
-			slog.Info("Inserting new provisioner into state file", slog.String("res-type", newProv.ResourceType), slog.String("res-class", newProv.ResourceClass), slog.String("res-id", newProv.ResourceId))
-			existingProvisioners := sd.State.Extras.Provisioners
-			existingProvisioners = slices.DeleteFunc(existingProvisioners, func(provisioner state.Provisioner) bool {
-				if provisioner.ProvisionerId == newProv.ProvisionerId {
-					slog.Info("Removing existing provisioner with the same id", slog.String("id", provisioner.ProvisionerId))
-					return true
-				} else if provisioner.ResourceType == newProv.ResourceType && provisioner.ResourceClass == newProv.ResourceClass && provisioner.ResourceId == newProv.ResourceId {
-					slog.Info("Removing existing provisioner with the same res type, class, and id", slog.String("id", provisioner.ProvisionerId))
-					return true
+			before, _ := cmd.Flags().GetString(addProvBeforeFlag)
+			after, _ := cmd.Flags().GetString(addProvAfterFlag)
+			replace, _ := cmd.Flags().GetBool(addProvReplaceFlag)
+			existingProvisioners := slices.Clone(sd.State.Extras.Provisioners)
+			if i := slices.IndexFunc(existingProvisioners, func(provisioner state.Provisioner) bool {
+				return provisioner.ProvisionerId == newProv.ProvisionerId
+			}); i >= 0 {
+				if !replace {
+					return fmt.Errorf("a provisioner with id '%s' already exists, use --%s to replace it", newProv.ProvisionerId, addProvReplaceFlag)
 				}
-				return false
+			}
+			keepIndex := -1
+			if replace {
+				kept := 0
+				existingProvisioners = slices.DeleteFunc(existingProvisioners, func(provisioner state.Provisioner) bool {
+					if provisioner.ProvisionerId == newProv.ProvisionerId {
+						// a replaced provisioner keeps its position unless otherwise requested
+						keepIndex = kept
+						slog.Info("Replacing existing provisioner with the same id", slog.String("id", provisioner.ProvisionerId))
+						return true
+					} else if provisioner.ResourceType == newProv.ResourceType && provisioner.ResourceClass == newProv.ResourceClass && provisioner.ResourceId == newProv.ResourceId && maps.Equal(provisioner.ResourceAnnotations, newProv.ResourceAnnotations) {
+						slog.Info("Replacing existing provisioner with the same res type, class, id, and annotations", slog.String("id", provisioner.ProvisionerId))
+						return true
+					}
+					kept++
+					return false
+				})
+			}
+
+			slog.Info("Inserting new provisioner into state file", slog.String("res-type", newProv.ResourceType), slog.String("res-class", newProv.ResourceClass), slog.String("res-id", newProv.ResourceId))
+			if keepIndex >= 0 && before == "" && after == "" {
+				sd.State.Extras.Provisioners = slices.Insert(existingProvisioners, keepIndex, newProv)
+			} else if sd.State.Extras.Provisioners, err = insertProvisioner(existingProvisioners, newProv, before, after); err != nil {
+				return err
+			}
+			slog.Info("Writing new state directory", "dir", sd.Path)
+			if err := sd.Persist(); err != nil {
+				return fmt.Errorf("failed to persist new state directory: %w", err)
+			}
+			return nil
+		},
+	}
+
+	moveProvisioner = &cobra.Command{
+		Use:           fmt.Sprintf("move PROVISIONER_ID (--%s|--%s) OTHER_PROVISIONER_ID", addProvBeforeFlag, addProvAfterFlag),
+		Short:         "Move a provisioner to a new position in the list",
+		Args:          cobra.ExactArgs(1),
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			sd, ok, err := state.LoadStateDirectory(".")
+			if err != nil {
+				return fmt.Errorf("failed to load existing state directory: %w", err)
+			} else if !ok {
+				return fmt.Errorf("state directory does not exist, please run \"score-flyio init\" first")
+			}
+			i := slices.IndexFunc(sd.State.Extras.Provisioners, func(provisioner state.Provisioner) bool {
+				return provisioner.ProvisionerId == args[0]
 			})
-			sd.State.Extras.Provisioners = append([]state.Provisioner{newProv}, existingProvisioners...)
+			if i < 0 {
+				return fmt.Errorf("no provisioner with id '%s'", args[0])
+			}
+			before, _ := cmd.Flags().GetString(addProvBeforeFlag)
+			after, _ := cmd.Flags().GetString(addProvAfterFlag)
+			if before == args[0] || after == args[0] {
+				return fmt.Errorf("cannot move a provisioner relative to itself")
+			}
+			p := sd.State.Extras.Provisioners[i]
+			if sd.State.Extras.Provisioners, err = insertProvisioner(slices.Delete(slices.Clone(sd.State.Extras.Provisioners), i, i+1), p, before, after); err != nil {
+				return err
+			}
 			slog.Info("Writing new state directory", "dir", sd.Path)
 			if err := sd.Persist(); err != nil {
 				return fmt.Errorf("failed to persist new state directory: %w", err)
@@ -123,6 +256,102 @@ var (
 		},
 	}
 
+	showProvisioner = &cobra.Command{
+		Use:           "show PROVISIONER_ID",
+		Short:         "Print the full configuration of a provisioner",
+		Args:          cobra.ExactArgs(1),
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			sd, ok, err := state.LoadStateDirectory(".")
+			if err != nil {
+				return fmt.Errorf("failed to load existing state directory: %w", err)
+			} else if !ok {
+				return fmt.Errorf("state directory does not exist, please run \"score-flyio init\" first")
+			}
+			i := slices.IndexFunc(sd.State.Extras.Provisioners, func(provisioner state.Provisioner) bool {
+				return provisioner.ProvisionerId == args[0]
+			})
+			if i < 0 {
+				return fmt.Errorf("no provisioner with id '%s'", args[0])
+			}
+			enc := yaml.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent(2)
+			return enc.Encode(sd.State.Extras.Provisioners[i])
+		},
+	}
+
+	testProvisioner = &cobra.Command{
+		Use:   "test PROVISIONER_ID",
+		Short: "Run a provision, idempotent re-provision, and deprovision of a scratch resource to check the provisioner",
+		Long: `Run a provision, idempotent re-provision, and deprovision of a scratch resource to check the provisioner.
+
+The scratch resource is not recorded in the project state, but any external side effects of the provisioner will occur.
+Each provisioner response is strictly decoded and the resource state, values, and shared state are checked for stability
+between the two provision calls.
+`,
+		Args:          cobra.ExactArgs(1),
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			sd, ok, err := state.LoadStateDirectory(".")
+			if err != nil {
+				return fmt.Errorf("failed to load existing state directory: %w", err)
+			} else if !ok {
+				return fmt.Errorf("state directory does not exist, please run \"score-flyio init\" first")
+			}
+			i := slices.IndexFunc(sd.State.Extras.Provisioners, func(provisioner state.Provisioner) bool {
+				return provisioner.ProvisionerId == args[0]
+			})
+			if i < 0 {
+				return fmt.Errorf("no provisioner with id '%s'", args[0])
+			}
+			provisioner := sd.State.Extras.Provisioners[i]
+
+			resource := scoretypes.Resource{Type: provisioner.ResourceType}
+			if v, _ := cmd.Flags().GetString(testProvTypeFlag); v != "" {
+				resource.Type = v
+			} else if strings.ContainsAny(resource.Type, "*?[\\") {
+				return fmt.Errorf("--%s must be set since the provisioner resource type is a pattern", testProvTypeFlag)
+			}
+			if v, _ := cmd.Flags().GetString(testProvClassFlag); v != "" {
+				resource.Class = &v
+			}
+			if v, _ := cmd.Flags().GetString(testProvIdFlag); v != "" {
+				resource.Id = &v
+			}
+			if v, _ := cmd.Flags().GetString(testProvParamsFlag); v != "" {
+				if err := json.Unmarshal([]byte(v), &resource.Params); err != nil {
+					return fmt.Errorf("--%s is not a valid json object: %w", testProvParamsFlag, err)
+				}
+			}
+			if v, _ := cmd.Flags().GetString(testProvMetaFlag); v != "" {
+				if err := json.Unmarshal([]byte(v), &resource.Metadata); err != nil {
+					return fmt.Errorf("--%s is not a valid json object: %w", testProvMetaFlag, err)
+				}
+			}
+
+			steps, err := provisioners.CheckConformance(provisioner, sd.State.Extras.AppPrefix, resource)
+			if err != nil {
+				return err
+			}
+			problems := 0
+			for _, step := range steps {
+				if len(step.Problems) == 0 {
+					_, _ = fmt.Fprintf(cmd.OutOrStdout(), "%s: ok\n", step.Name)
+				}
+				for _, problem := range step.Problems {
+					_, _ = fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", step.Name, problem)
+				}
+				problems += len(step.Problems)
+			}
+			if problems > 0 {
+				return fmt.Errorf("provisioner '%s' failed the test with %d problems", provisioner.ProvisionerId, problems)
+			}
+			return nil
+		},
+	}
+
 	removeProvisioner = &cobra.Command{
 		Use:           "remove PROVISIONER_ID",
 		Args:          cobra.ExactArgs(1),
@@ -152,19 +381,43 @@ var (
 )
 
 func init() {
-	addProvisioner.Flags().String(addProvResClassFlag, "", "The resource class to match")
-	addProvisioner.Flags().String(addProvResIdFlag, "", "The resource id to match")
+	addProvisioner.Flags().String(addProvResClassFlag, "", "The resource class glob pattern to match")
+	addProvisioner.Flags().String(addProvResIdFlag, "", "The resource id glob pattern to match")
+	addProvisioner.Flags().StringArray(addProvResAnnotFlag, nil, "A key=pattern resource metadata annotation to match, may be repeated")
+	addProvisioner.Flags().Bool(addProvFallbackFlag, false, "Try the next matching provisioner if this provisioner fails")
+	addProvisioner.Flags().StringSlice(addProvExpValuesFlag, nil, "The output value keys that the provisioner must return")
+	addProvisioner.Flags().StringSlice(addProvExpSecretsFlag, nil, "The output secret keys that the provisioner must return")
 
 	addProvisioner.Flags().String(addProvCmdStaticFlag, "", "The static json to return for this provisioner")
 	addProvisioner.Flags().String(addProvCmdBinFlag, "", "The binary to execute for a cmd provisioner")
 	addProvisioner.Flags().StringSlice(addProvCmdBinArgsFlag, nil, "The arguments to the binary to execute")
 	addProvisioner.Flags().String(addProvHttpUrlFlag, "", "The http url to request for an http provisioner")
+	addProvisioner.Flags().Duration(addProvHttpPollFlag, 0, "The maximum time to poll an asynchronous http provisioner operation (default 30m)")
+
+	addProvisioner.Flags().String(addProvBeforeFlag, "", "Insert the provisioner before the provisioner with this id instead of at the top of the list")
+	addProvisioner.Flags().String(addProvAfterFlag, "", "Insert the provisioner after the provisioner with this id instead of at the top of the list")
+	addProvisioner.Flags().Bool(addProvReplaceFlag, false, "Replace any existing provisioner with the same id or the same resource type, class, id, and annotations")
+	addProvisioner.MarkFlagsMutuallyExclusive(addProvBeforeFlag, addProvAfterFlag)
+
+	moveProvisioner.Flags().String(addProvBeforeFlag, "", "Move the provisioner before the provisioner with this id")
+	moveProvisioner.Flags().String(addProvAfterFlag, "", "Move the provisioner after the provisioner with this id")
+	moveProvisioner.MarkFlagsOneRequired(addProvBeforeFlag, addProvAfterFlag)
+	moveProvisioner.MarkFlagsMutuallyExclusive(addProvBeforeFlag, addProvAfterFlag)
+
+	testProvisioner.Flags().String(testProvTypeFlag, "", "The resource type to test, defaults to the provisioner resource type")
+	testProvisioner.Flags().String(testProvClassFlag, "", "The resource class to test")
+	testProvisioner.Flags().String(testProvIdFlag, "", "The resource id to test")
+	testProvisioner.Flags().String(testProvParamsFlag, "", "The resource params as a json object")
+	testProvisioner.Flags().String(testProvMetaFlag, "", "The resource metadata as a json object")
 
 	addProvisioner.MarkFlagsOneRequired(addProvCmdStaticFlag, addProvHttpUrlFlag, addProvCmdBinFlag)
 	addProvisioner.MarkFlagsMutuallyExclusive(addProvCmdStaticFlag, addProvHttpUrlFlag, addProvCmdBinFlag)
 
 	provisionersGroup.AddCommand(listProvisioners)
 	provisionersGroup.AddCommand(addProvisioner)
+	provisionersGroup.AddCommand(moveProvisioner)
+	provisionersGroup.AddCommand(showProvisioner)
+	provisionersGroup.AddCommand(testProvisioner)
 	provisionersGroup.AddCommand(removeProvisioner)
 	rootCmd.AddCommand(provisionersGroup)
 }
@@ -0,0 +1,433 @@
+// Copyright 2024 Humanitec
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/score-spec/score-go/framework"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+const asyncResourceScoreFile = `apiVersion: score.dev/v1b1
+metadata:
+  name: example
+containers:
+  main:
+    image: nginx
+    variables:
+      HOST: ${resources.thing.host}
+resources:
+  thing:
+    type: swamp
+`
+
+func TestGenerateWithAsyncHttpProvisioner(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(asyncResourceScoreFile), 0644))
+
+	var posts, polls atomic.Int32
+	var complete atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			posts.Add(1)
+			w.Header().Set("Location", "/operations/abc")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodGet && r.URL.Path == "/operations/abc":
+			polls.Add(1)
+			if !complete.Load() {
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			_, _ = w.Write([]byte(`{"values":{"host":"example.internal"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "async", "swamp", "--http-url", srv.URL + "/provision", "--http-poll-timeout=1ms"})
+	require.NoError(t, err)
+
+	// the first generate times out while the operation is still in progress
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.ErrorContains(t, err, "timed out after 1ms waiting for http provision operation")
+	sd, ok, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	require.True(t, ok)
+	rs := sd.State.Resources["swamp.default#example.thing"]
+	if assert.NotNil(t, rs.Extras.PendingOperation) {
+		assert.Equal(t, state.PendingOperation{ProvisionerId: "async", Method: http.MethodPost, Url: srv.URL + "/operations/abc"}, *rs.Extras.PendingOperation)
+	}
+
+	// the second generate resumes the pending operation without sending a new request
+	complete.Store(true)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), posts.Load())
+	assert.Equal(t, int32(2), polls.Load())
+
+	sd, _, err = state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	rs = sd.State.Resources["swamp.default#example.thing"]
+	assert.Nil(t, rs.Extras.PendingOperation)
+	assert.Equal(t, "async", rs.ProvisionerUri)
+	assert.Equal(t, map[string]interface{}{"host": "example.internal"}, rs.Outputs)
+}
+
+func TestGenerateWithFailedAsyncHttpOperation(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusInternalServerError} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			td := changeToTempDir(t)
+			require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(asyncResourceScoreFile), 0644))
+
+			var posts atomic.Int32
+			var failed atomic.Bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodPost && posts.Add(1) == 1:
+					w.Header().Set("Location", "/operations/abc")
+					w.WriteHeader(http.StatusAccepted)
+				case r.Method == http.MethodPost:
+					_, _ = w.Write([]byte(`{"values":{"host":"example.internal"}}`))
+				case r.Method == http.MethodGet && r.URL.Path == "/operations/abc" && failed.Load():
+					w.WriteHeader(status)
+				case r.Method == http.MethodGet && r.URL.Path == "/operations/abc":
+					w.WriteHeader(http.StatusAccepted)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+
+			_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+			require.NoError(t, err)
+			_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "async", "swamp", "--http-url", srv.URL + "/provision", "--http-poll-timeout=1ms"})
+			require.NoError(t, err)
+			_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+			require.ErrorContains(t, err, "timed out after 1ms waiting for http provision operation")
+
+			// the operation fails for good, so it is cleared rather than polled again on every run
+			failed.Store(true)
+			_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+			require.ErrorContains(t, err, fmt.Sprintf("http provision operation failed with status: %d", status))
+			sd, _, err := state.LoadStateDirectory(".")
+			require.NoError(t, err)
+			assert.Nil(t, sd.State.Resources["swamp.default#example.thing"].Extras.PendingOperation)
+
+			// the next run sends a new request
+			_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+			require.NoError(t, err)
+			assert.Equal(t, int32(2), posts.Load())
+			sd, _, err = state.LoadStateDirectory(".")
+			require.NoError(t, err)
+			assert.Equal(t, "async", sd.State.Resources["swamp.default#example.thing"].ProvisionerUri)
+		})
+	}
+}
+
+func TestDeprovisionWithFailedAsyncHttpOperation(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(asyncResourceScoreFile), 0644))
+
+	var deletes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			w.Header().Set("Location", "/operations/abc")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodDelete && deletes.Add(1) == 1:
+			w.Header().Set("Location", "/operations/def")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Path == "/operations/abc":
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "async", "swamp", "--http-url", srv.URL + "/provision", "--http-poll-timeout=1ms"})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.ErrorContains(t, err, "timed out after 1ms waiting for http provision operation")
+
+	// the resource has no provisioner yet, so the provisioner of the pending operation is asked to deprovision it
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"resources", "deprovision", "swamp.default#example.thing"})
+	require.ErrorContains(t, err, "http provision operation failed with status: 404")
+	sd, _, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	assert.Nil(t, sd.State.Resources["swamp.default#example.thing"].Extras.PendingOperation)
+
+	// the failed operation is not polled again
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"resources", "deprovision", "swamp.default#example.thing"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), deletes.Load())
+	sd, _, err = state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	assert.NotContains(t, sd.State.Resources, framework.ResourceUid("swamp.default#example.thing"))
+}
+
+func TestGenerateWithPendingAsyncFallbackProvisioner(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(asyncResourceScoreFile), 0644))
+
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			posts.Add(1)
+			w.Header().Set("Location", "/operations/abc")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodGet && r.URL.Path == "/operations/abc":
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "static", "swamp", "--static-json", `{"host":"static"}`})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "async", "swamp", "--fallback", "--http-url", srv.URL + "/provision", "--http-poll-timeout=1ms"})
+	require.NoError(t, err)
+
+	// the accepted operation is not abandoned in favour of the fallback provisioner
+	for range 2 {
+		_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+		require.ErrorContains(t, err, "timed out after 1ms waiting for http provision operation")
+	}
+	assert.Equal(t, int32(1), posts.Load())
+
+	sd, _, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	rs := sd.State.Resources["swamp.default#example.thing"]
+	assert.Empty(t, rs.ProvisionerUri)
+	if assert.NotNil(t, rs.Extras.PendingOperation) {
+		assert.Equal(t, "async", rs.Extras.PendingOperation.ProvisionerId)
+	}
+}
+
+func TestGenerateWithFallbackProvisioners(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(`apiVersion: score.dev/v1b1
+metadata:
+  name: example
+containers:
+  main:
+    image: nginx
+    variables:
+      HOST: ${resources.thing.host}
+resources:
+  thing:
+    type: swamp
+    metadata:
+      annotations:
+        region: lhr
+`), 0644))
+
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "other-region", "sw*", "--res-annotation", "region=ams", "--static-json", `{"host":"ams"}`})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "static", "sw*", "--res-annotation", "region=l*", "--static-json", `{"host":"lhr"}`})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "failing", "swamp", "--res-id", "example.*", "--fallback", "--cmd-binary", "false"})
+	require.NoError(t, err)
+
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+
+	sd, _, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	assert.Equal(t, "static", sd.State.Resources["swamp.default#example.thing"].ProvisionerUri)
+	assert.Equal(t, map[string]interface{}{"host": "lhr"}, sd.State.Resources["swamp.default#example.thing"].Outputs)
+
+	stdout, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "list"})
+	require.NoError(t, err)
+	assert.Contains(t, stdout, "[0]: failing (swamp.#example.*) CMD ")
+	assert.Contains(t, stdout, " (fallback)\n[1]: static (sw*.#) Static #1 region=l*\n    serves: swamp.default#example.thing\n[2]: other-region (sw*.#) Static #1 region=ams\n")
+}
+
+func TestProvisionerOrdering(t *testing.T) {
+	_ = changeToTempDir(t)
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+
+	listIds := func() []string {
+		sd, _, err := state.LoadStateDirectory(".")
+		require.NoError(t, err)
+		out := make([]string, 0, len(sd.State.Extras.Provisioners))
+		for _, p := range sd.State.Extras.Provisioners {
+			out = append(out, p.ProvisionerId)
+		}
+		return out
+	}
+
+	for _, args := range [][]string{
+		{"a", "thing", "--static-json={}"},
+		{"b", "thing", "--static-json={}"},
+		{"c", "thing", "--static-json={}", "--after", "a"},
+		{"d", "thing", "--static-json={}", "--before", "a"},
+	} {
+		_, _, err = executeAndResetCommand(context.Background(), rootCmd, append([]string{"provisioners", "add"}, args...))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"b", "d", "a", "c"}, listIds())
+
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "a", "other", "--static-json={}"})
+	assert.EqualError(t, err, "a provisioner with id 'a' already exists, use --replace to replace it")
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "a", "other", "--static-json={\"x\":\"y\"}", "--replace"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "d", "a", "c"}, listIds())
+
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "move", "b", "--after", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d", "a", "c", "b"}, listIds())
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "move", "c", "--before", "d"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "d", "a", "b"}, listIds())
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "move", "c", "--before", "unknown"})
+	assert.EqualError(t, err, "no provisioner with id 'unknown'")
+
+	stdout, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "show", "a"})
+	require.NoError(t, err)
+	assert.Equal(t, `id: a
+resource_type: other
+static:
+  x: "y"
+`, stdout)
+}
+
+func TestProvisionerConformance(t *testing.T) {
+	_ = changeToTempDir(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			_, _ = fmt.Fprintf(w, `{"state":{"call":%d},"values":{"host":"example"}}`, calls.Add(1))
+		}
+	}))
+	defer srv.Close()
+
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "stable", "thing", "--static-json", `{"host":"example"}`})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "unstable", "thing*", "--http-url", srv.URL})
+	require.NoError(t, err)
+
+	stdout, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "test", "stable", "--params", `{"a":"b"}`})
+	require.NoError(t, err)
+	assert.Equal(t, "provision: ok\nprovision again: ok\ndeprovision: ok\n", stdout)
+
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "test", "unstable"})
+	assert.EqualError(t, err, "--type must be set since the provisioner resource type is a pattern")
+
+	stdout, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "test", "unstable", "--type", "thing"})
+	assert.EqualError(t, err, "provisioner 'unstable' failed the test with 1 problems")
+	assert.Equal(t, "provision: ok\nprovision again: resource state is not stable across calls: map[call:1] != map[call:2]\ndeprovision: ok\n", stdout)
+
+	sd, _, err := state.LoadStateDirectory(".")
+	require.NoError(t, err)
+	assert.Len(t, sd.State.Resources, 0)
+}
+
+func TestProvisionerConformanceCleanup(t *testing.T) {
+	_ = changeToTempDir(t)
+	var deletes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deletes.Add(1)
+		case r.URL.Path == "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			// adding a shared state key that is left in place after deprovision is allowed
+			_, _ = w.Write([]byte(`{"values":{"host":"example"},"shared":{"cluster":"shared-cluster"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "shared", "thing", "--http-url", srv.URL + "/shared"})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "broken", "thing", "--http-url", srv.URL + "/broken"})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "broken-fallback", "thing", "--fallback", "--http-url", srv.URL + "/broken"})
+	require.NoError(t, err)
+
+	stdout, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "test", "shared"})
+	require.NoError(t, err)
+	assert.Equal(t, "provision: ok\nprovision again: ok\ndeprovision: ok\n", stdout)
+	assert.Equal(t, int32(1), deletes.Load())
+
+	// the deprovision still runs when the provision fails
+	stdout, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "test", "broken"})
+	assert.EqualError(t, err, "provisioner 'broken' failed the test with 1 problems")
+	assert.Contains(t, stdout, "provision: thing.default#conformance.res: failed to call provisioner: ")
+	assert.True(t, strings.HasSuffix(stdout, "\ndeprovision: ok\n"), stdout)
+	assert.Equal(t, int32(2), deletes.Load())
+
+	// a failed fallback provisioner drops the resource from the state, but is still asked to deprovision it
+	stdout, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "test", "broken-fallback"})
+	assert.EqualError(t, err, "provisioner 'broken-fallback' failed the test with 1 problems")
+	assert.Contains(t, stdout, "provision: all matching provisioners failed for 'thing.default#conformance.res': ")
+	assert.True(t, strings.HasSuffix(stdout, "\ndeprovision: ok\n"), stdout)
+	assert.Equal(t, int32(3), deletes.Load())
+}
+
+func TestGenerateWithExpectedOutputs(t *testing.T) {
+	td := changeToTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(td, "score.yaml"), []byte(asyncResourceScoreFile), 0644))
+	_, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"init", "--fly-app-prefix=example", "--file="})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "static", "swamp", "--static-json", `{"host":"example"}`})
+	require.NoError(t, err)
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	require.NoError(t, err)
+
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"provisioners", "add", "static", "swamp", "--static-json", `{"host":"example"}`, "--replace", "--expect-values", "host,port", "--expect-secrets", "password"})
+	require.NoError(t, err)
+	stdout, _, err := executeAndResetCommand(context.Background(), rootCmd, []string{"resources", "list"})
+	require.NoError(t, err)
+	assert.Equal(t, `uid                         source_workload provisioner outputs           missing_outputs 
+swamp.default#example.thing example         static      map[host:example] port            
+`, stdout)
+
+	_, _, err = executeAndResetCommand(context.Background(), rootCmd, []string{"generate", "score.yaml"})
+	assert.EqualError(t, err, "failed to provision resources: swamp.default#example.thing: provisioner 'static' did not return the expected outputs: missing values [port], missing secrets [password]")
+}
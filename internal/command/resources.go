@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"maps"
 	"slices"
+	"strings"
 
 	"github.com/score-spec/score-go/framework"
 	"github.com/spf13/cobra"
@@ -37,6 +38,13 @@ var (
 				return fmt.Errorf("state directory does not exist, please run \"score-flyio init\" first")
 			}
 			things := slices.Collect(iterMap2To1(maps.All(sd.State.Resources), func(uid framework.ResourceUid, st framework.ScoreResourceState[state.ResourceExtras]) thingprinter.PrintableMap {
+				// secrets are not persisted, so only the missing values can be determined here
+				var missing []string
+				if i := slices.IndexFunc(sd.State.Extras.Provisioners, func(p state.Provisioner) bool {
+					return p.ProvisionerId == st.ProvisionerUri
+				}); i >= 0 {
+					missing, _ = sd.State.Extras.Provisioners[i].MissingOutputs(st.Outputs, nil)
+				}
 				return thingprinter.PrintableMap{
 					"uid":             string(uid),
 					"type":            st.Type,
@@ -46,9 +54,10 @@ var (
 					"provisioner":     st.ProvisionerUri,
 					"state":           st.State,
 					"outputs":         st.Outputs,
+					"missing_outputs": strings.Join(missing, ","),
 				}
 			}))
-			columns := []string{"uid", "source_workload", "provisioner", "outputs"}
+			columns := []string{"uid", "source_workload", "provisioner", "outputs", "missing_outputs"}
 			return thingprinter.PrintTable(cmd.OutOrStdout(), columns, things)
 		},
 	}
@@ -65,7 +74,10 @@ var (
 			} else if !ok {
 				return fmt.Errorf("state directory does not exist, please run \"score-flyio init\" first")
 			}
-			out, err := provisioners.DeProvisionResource(&sd.State, framework.ResourceUid(args[0]))
+			out, err := provisioners.DeProvisionResource(&sd.State, framework.ResourceUid(args[0]), func(s *state.State) error {
+				sd.State = *s
+				return sd.Persist()
+			})
 			if err != nil {
 				return fmt.Errorf("failed to deprovision: %w", err)
 			}
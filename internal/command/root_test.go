@@ -50,11 +50,12 @@ func executeAndResetCommand(ctx context.Context, cmd *cobra.Command, args []stri
 		subCmd.SetContext(context.TODO())
 		subCmd.SilenceUsage = false
 		subCmd.Flags().VisitAll(func(f *pflag.Flag) {
-			if f.Value.Type() == "stringArray" {
-				_ = f.Value.(pflag.SliceValue).Replace(nil)
+			if sv, ok := f.Value.(pflag.SliceValue); ok {
+				_ = sv.Replace(nil)
 			} else {
 				_ = f.Value.Set(f.DefValue)
 			}
+			f.Changed = false
 		})
 	}
 	return nowOut.String(), nowErr.String(), err
@@ -0,0 +1,257 @@
+package convert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// annotationType describes how the string value of an annotation is interpreted and validated.
+type annotationType string
+
+const (
+	annotationString     annotationType = "string"
+	annotationInteger    annotationType = "integer"
+	annotationNumber     annotationType = "number"
+	annotationBoolean    annotationType = "boolean"
+	annotationDuration   annotationType = "duration"
+	annotationList       annotationType = "list"
+	annotationJsonObject annotationType = "json-object"
+	annotationJsonArray  annotationType = "json-array"
+	annotationYaml       annotationType = "yaml"
+	annotationSize       annotationType = "size"
+)
+
+// portPlaceholder is replaced by the name of a service port in annotation name patterns.
+const portPlaceholder = "<port>"
+
+// annotationPlaceholders are the placeholders that may appear in annotation name patterns.
+var annotationPlaceholders = []string{portPlaceholder, volumePlaceholder}
+
+// placeholderDescriptions describe the values of each placeholder in validation errors.
+var placeholderDescriptions = map[string]string{portPlaceholder: "service port", volumePlaceholder: "volume"}
+
+// annotationSpec describes a single supported workload annotation.
+type annotationSpec struct {
+	// Name is the annotation name after the prefix. It may contain one placeholder to match any service port or volume.
+	Name        string
+	Type        annotationType
+	Description string
+	// Enum restricts the value to one of the given strings.
+	Enum []string
+	// Minimum and Maximum are the inclusive bounds of integer and number annotations.
+	Minimum *float64
+	Maximum *float64
+}
+
+var (
+	zero           = 0.0
+	one            = 1.0
+	ninetyNine     = 99.0
+	sixty          = 60.0
+	autoStopValues = []string{"off", "stop", "suspend"}
+)
+
+// annotationSpecs is the typed schema of all the annotations supported on a workload.
+var annotationSpecs = []annotationSpec{
+	{Name: "service-<port>-handlers", Type: annotationList, Description: "Comma-separated Fly Proxy connection handlers for the port."},
+	{Name: "service-<port>-http-options", Type: annotationJsonObject, Description: "JSON object of http_options for the port."},
+	{Name: "service-<port>-auto-stop", Type: annotationString, Enum: autoStopValues, Description: "Fly Proxy auto-stop mode for the service, this also enables auto-start."},
+	{Name: "service-<port>-min-running", Type: annotationInteger, Minimum: &zero, Description: "Minimum number of machines that must remain running."},
+	{Name: "service-<port>-concurrency", Type: annotationJsonObject, Description: "JSON object of Fly Proxy concurrency settings for the service."},
+	{Name: "service-<port>-http", Type: annotationBoolean, Description: "Whether the port is converted into an http_service."},
+	{Name: "service-<port>-force-https", Type: annotationBoolean, Description: "Whether the http_service redirects http requests to https."},
+	{Name: "service-<port>-private", Type: annotationBoolean, Description: "Whether the port is only reachable through a Flycast private ip, this defaults to the project default from init."},
+	{Name: vmSizeAnnotation, Type: annotationString, Enum: vmSizes(), Description: "Fly machine size preset, the memory is still derived from the container resources."},
+	{Name: vmCpuKindAnnotation, Type: annotationString, Enum: vmCpuKinds, Description: "Fly machine cpu kind used to choose the nearest machine size."},
+	{Name: livenessProbe + "-" + checkGracePeriodSuffix, Type: annotationDuration, Description: "Time to wait after the machine starts before running the liveness check."},
+	{Name: livenessProbe + "-" + checkIntervalSuffix, Type: annotationDuration, Description: "Time between liveness checks."},
+	{Name: livenessProbe + "-" + checkTimeoutSuffix, Type: annotationDuration, Description: "Maximum time a liveness check may take."},
+	{Name: readinessProbe + "-" + checkGracePeriodSuffix, Type: annotationDuration, Description: "Time to wait after the machine starts before running the readiness check."},
+	{Name: readinessProbe + "-" + checkIntervalSuffix, Type: annotationDuration, Description: "Time between readiness checks."},
+	{Name: readinessProbe + "-" + checkTimeoutSuffix, Type: annotationDuration, Description: "Maximum time a readiness check may take."},
+	{Name: tcpCheckAnnotationPrefix + "<port>", Type: annotationString, Enum: tcpCheckModes, Description: "Adds a tcp check for the port to the Fly Proxy service or as a top-level machine check."},
+	{Name: execProbeStrategyAnnotation, Type: annotationString, Enum: execProbeStrategies, Description: "How exec probes are converted, the shim strategy serves them as http checks from a wrapper script that requires /bin/sh, mkfifo, mktemp, and nc -l -p in the image."},
+	{Name: execProbePortAnnotation, Type: annotationInteger, Minimum: &one, Description: "Port that the exec probe shim listens on."},
+	{Name: metricsPortAnnotation, Type: annotationInteger, Minimum: &one, Description: "Target port that Fly scrapes Prometheus metrics from, this must match one of the service target ports."},
+	{Name: metricsPathAnnotation, Type: annotationString, Description: "Path that Fly scrapes Prometheus metrics from, defaults to /metrics."},
+	{Name: staticsAnnotation, Type: annotationJsonArray, Description: "JSON list of {guest_path, url_prefix} entries served as statics by the Fly Proxy."},
+	{Name: killSignalAnnotation, Type: annotationString, Enum: killSignals, Description: "Signal sent to the process to stop the machine."},
+	{Name: killTimeoutAnnotation, Type: annotationDuration, Description: "Time to wait after the kill signal before the machine is forcibly stopped, at most 5m."},
+	{Name: swapSizeAnnotation, Type: annotationInteger, Minimum: &zero, Description: "Size of the swap file in MB."},
+	{Name: restartPolicyAnnotation, Type: annotationString, Enum: restartPolicies, Description: "Machine restart policy."},
+	{Name: restartRetriesAnnotation, Type: annotationInteger, Minimum: &zero, Description: "Maximum number of restarts for the on-failure restart policy."},
+	{Name: "volume-<volume>-initial-size", Type: annotationSize, Description: "Initial size of the volume created on first deploy."},
+	{Name: "volume-<volume>-auto-extend-size-threshold", Type: annotationInteger, Minimum: &one, Maximum: &ninetyNine, Description: "Percentage of used space at which the volume is extended."},
+	{Name: "volume-<volume>-auto-extend-size-increment", Type: annotationSize, Description: "Size to extend the volume by."},
+	{Name: "volume-<volume>-auto-extend-size-limit", Type: annotationSize, Description: "Maximum size that the volume is extended to."},
+	{Name: "volume-<volume>-snapshot-retention", Type: annotationInteger, Minimum: &one, Maximum: &sixty, Description: "Number of days that volume snapshots are retained."},
+	{Name: initShimAnnotation, Type: annotationBoolean, Description: "Wraps the container command with an init script that emulates file modes, volume sub-paths, and read-only volumes."},
+	{Name: regionsAnnotation, Type: annotationList, Description: "Comma-separated Fly regions to run machines in, each optionally followed by =<count>. The first region is the primary region."},
+	{Name: buildArgsAnnotation, Type: annotationJsonObject, Description: "JSON object of Dockerfile build args for containers with image '.'."},
+	{Name: buildTargetAnnotation, Type: annotationString, Description: "Dockerfile target stage for containers with image '.'."},
+	{Name: buildSecretsAnnotation, Type: annotationJsonObject, Description: "JSON object mapping build secret ids to a file path or env:<NAME>, only used with generate --build."},
+	{Name: configPatchAnnotation, Type: annotationYaml, Description: "JSON or YAML merge patch object or JSON patch array applied to the generated Fly config."},
+	{Name: appGroupAnnotation, Type: annotationString, Description: "Merges workloads with the same app group into a single Fly app with a process group per workload."},
+	{Name: deployStrategyAnnotation, Type: annotationString, Enum: deployStrategies, Description: "Fly deploy strategy."},
+	{Name: deployReleaseCommandAnnotation, Type: annotationString, Description: "Command to run in a temporary machine before each deployment."},
+	{Name: deployMaxUnavailableAnnotation, Type: annotationNumber, Minimum: &zero, Description: "Fraction or number of machines that may be unavailable during a rolling deployment."},
+	{Name: deployWaitTimeoutAnnotation, Type: annotationDuration, Description: "Time to wait for machines to become healthy during a deployment."},
+}
+
+// match returns true if the annotation name matches the spec. For annotations with a placeholder, the placeholder and
+// the value that it matched are returned too.
+func (s annotationSpec) match(name string) (placeholder string, value string, ok bool) {
+	for _, placeholder = range annotationPlaceholders {
+		if before, after, found := strings.Cut(s.Name, placeholder); found {
+			if len(name) <= len(before)+len(after) || !strings.HasPrefix(name, before) || !strings.HasSuffix(name, after) {
+				return "", "", false
+			}
+			return placeholder, name[len(before) : len(name)-len(after)], true
+		}
+	}
+	return "", "", name == s.Name
+}
+
+// validate checks that the annotation value is valid for the type of the spec.
+func (s annotationSpec) validate(value string) error {
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, value) {
+		return fmt.Errorf("'%s' is not one of %v", value, s.Enum)
+	}
+	var number *float64
+	switch s.Type {
+	case annotationInteger:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", value)
+		}
+		f := float64(i)
+		number = &f
+	case annotationNumber:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a number", value)
+		}
+		number = &f
+	case annotationBoolean:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("'%s' is not a boolean", value)
+		}
+	case annotationDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("'%s' is not a duration", value)
+		}
+	case annotationJsonObject:
+		var out map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &out); err != nil {
+			return fmt.Errorf("is not a json object: %w", err)
+		}
+	case annotationJsonArray:
+		var out []interface{}
+		if err := json.Unmarshal([]byte(value), &out); err != nil {
+			return fmt.Errorf("is not a json array: %w", err)
+		}
+	case annotationSize:
+		if !volumeSizeReg.MatchString(value) {
+			return fmt.Errorf("'%s' is not a size in gb or mb", value)
+		}
+	case annotationYaml:
+		var out interface{}
+		if err := yaml.Unmarshal([]byte(value), &out); err != nil {
+			return fmt.Errorf("is not valid json or yaml: %w", err)
+		}
+	}
+	if number != nil && s.Minimum != nil && *number < *s.Minimum {
+		return fmt.Errorf("'%s' must be at least %v", value, *s.Minimum)
+	} else if number != nil && s.Maximum != nil && *number > *s.Maximum {
+		return fmt.Errorf("'%s' must be at most %v", value, *s.Maximum)
+	}
+	return nil
+}
+
+// validateAnnotations checks all the prefixed workload annotations against the annotation schema and returns all the
+// problems found. Annotations with a placeholder must refer to one of the known values for that placeholder, such as
+// the service port names, which may themselves contain dashes.
+func validateAnnotations(workloadAnnotations map[string]interface{}, placeholders map[string][]string) error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(workloadAnnotations)) {
+		name, ok := strings.CutPrefix(key, annotationPrefix)
+		if !ok {
+			continue
+		}
+		var spec *annotationSpec
+		var unknown string
+		for i, s := range annotationSpecs {
+			if placeholder, value, ok := s.match(name); !ok {
+				continue
+			} else if placeholder != "" && !slices.Contains(placeholders[placeholder], value) {
+				unknown = fmt.Sprintf("%s '%s' does not exist", placeholderDescriptions[placeholder], value)
+				continue
+			}
+			spec = &annotationSpecs[i]
+			break
+		}
+		if spec == nil {
+			if unknown != "" {
+				errs = append(errs, fmt.Errorf("annotation '%s': %s", key, unknown))
+			} else {
+				errs = append(errs, fmt.Errorf("unrecognised %s annotation: '%s'", annotationPrefix, key))
+			}
+			continue
+		}
+		if value, ok := workloadAnnotations[key].(string); !ok {
+			errs = append(errs, fmt.Errorf("annotation '%s': value must be a string", key))
+		} else if err := spec.validate(value); err != nil {
+			errs = append(errs, fmt.Errorf("annotation '%s': %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AnnotationsJsonSchema returns a JSON schema describing the supported workload annotations.
+func AnnotationsJsonSchema() map[string]interface{} {
+	properties := make(map[string]interface{})
+	patternProperties := make(map[string]interface{})
+	for _, spec := range annotationSpecs {
+		prop := map[string]interface{}{"type": "string", "description": spec.Description}
+		if len(spec.Enum) > 0 {
+			prop["enum"] = spec.Enum
+		}
+		switch spec.Type {
+		case annotationInteger:
+			prop["pattern"] = `^-?[0-9]+$`
+		case annotationSize:
+			prop["pattern"] = volumeSizeReg.String()
+		case annotationBoolean:
+			prop["enum"] = []string{"true", "false"}
+		case annotationDuration:
+			prop["format"] = "duration"
+		case annotationJsonObject, annotationJsonArray:
+			prop["contentMediaType"] = "application/json"
+		case annotationYaml:
+			prop["contentMediaType"] = "application/yaml"
+		}
+		if placeholder, _, _ := spec.match(spec.Name); placeholder != "" {
+			before, after, _ := strings.Cut(spec.Name, placeholder)
+			pattern := "^" + regexp.QuoteMeta(annotationPrefix+before) + ".+" + regexp.QuoteMeta(after) + "$"
+			patternProperties[pattern] = prop
+		} else {
+			properties[annotationPrefix+spec.Name] = prop
+		}
+	}
+	return map[string]interface{}{
+		"$schema":           "https://json-schema.org/draft/2020-12/schema",
+		"title":             "score-flyio workload annotations",
+		"type":              "object",
+		"properties":        properties,
+		"patternProperties": patternProperties,
+	}
+}
@@ -0,0 +1,44 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+const (
+	buildArgsAnnotation    = "build-args"
+	buildTargetAnnotation  = "build-target"
+	buildSecretsAnnotation = "build-secrets"
+)
+
+// BuildOptions are the Dockerfile build settings from the workload annotations.
+type BuildOptions struct {
+	Args   map[string]string
+	Target string
+	// Secrets maps each build secret id to either a file path or env:<NAME>.
+	Secrets map[string]string
+}
+
+// WorkloadBuildOptions returns the build args, target stage, and build secrets from the workload annotations.
+func WorkloadBuildOptions(currentState *state.State, workloadName string) (*BuildOptions, error) {
+	workloadAnnotations, _ := currentState.Workloads[workloadName].Spec.Metadata["annotations"].(map[string]interface{})
+	return buildOptions(workloadAnnotations)
+}
+
+func buildOptions(workloadAnnotations map[string]interface{}) (*BuildOptions, error) {
+	out := &BuildOptions{}
+	out.Target, _ = workloadAnnotations[annotationPrefix+buildTargetAnnotation].(string)
+	if v, _ := workloadAnnotations[annotationPrefix+buildArgsAnnotation].(string); v != "" {
+		if err := json.Unmarshal([]byte(v), &out.Args); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal build args as a json object of strings: %w", err)
+		}
+	}
+	if v, _ := workloadAnnotations[annotationPrefix+buildSecretsAnnotation].(string); v != "" {
+		if err := json.Unmarshal([]byte(v), &out.Secrets); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal build secrets as a json object of strings: %w", err)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,140 @@
+package convert
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	scoretypes "github.com/score-spec/score-go/types"
+
+	"github.com/astromechza/score-flyio/internal"
+	"github.com/astromechza/score-flyio/internal/appconfig"
+)
+
+// The probes and settings that make up the <probe>-<setting> check timing annotations.
+const (
+	livenessProbe          = "liveness"
+	readinessProbe         = "readiness"
+	checkGracePeriodSuffix = "grace-period"
+	checkIntervalSuffix    = "interval"
+	checkTimeoutSuffix     = "timeout"
+)
+
+// checkTimingRanges are the inclusive bounds that Fly accepts for each of the check timing settings.
+var checkTimingRanges = map[string][2]time.Duration{
+	checkGracePeriodSuffix: {0, time.Hour},
+	checkIntervalSuffix:    {time.Second, time.Hour},
+	checkTimeoutSuffix:     {time.Second, time.Hour},
+}
+
+// checkTiming holds the optional timing settings of a check as Fly duration strings.
+type checkTiming struct {
+	GracePeriod string
+	Interval    string
+	Timeout     string
+}
+
+// buildCheckTiming reads the <probe>-grace-period, <probe>-interval, and <probe>-timeout annotations for the given
+// probe and validates them against the ranges that Fly allows.
+func buildCheckTiming(workloadAnnotations map[string]interface{}, probe string) (checkTiming, error) {
+	var timing checkTiming
+	durations := make(map[string]time.Duration)
+	for _, setting := range []string{checkGracePeriodSuffix, checkIntervalSuffix, checkTimeoutSuffix} {
+		v, _ := workloadAnnotations[fmt.Sprintf("%s%s-%s", annotationPrefix, probe, setting)].(string)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return timing, fmt.Errorf("failed to parse %s '%s' as a duration: %w", setting, v, err)
+		} else if r := checkTimingRanges[setting]; d < r[0] || d > r[1] {
+			return timing, fmt.Errorf("%s '%s' must be between %s and %s", setting, v, r[0], r[1])
+		}
+		durations[setting] = d
+		switch setting {
+		case checkGracePeriodSuffix:
+			timing.GracePeriod = v
+		case checkIntervalSuffix:
+			timing.Interval = v
+		case checkTimeoutSuffix:
+			timing.Timeout = v
+		}
+	}
+	if i, ok := durations[checkIntervalSuffix]; ok {
+		if t, ok := durations[checkTimeoutSuffix]; ok && t > i {
+			return timing, fmt.Errorf("timeout '%s' must not be longer than the interval '%s'", timing.Timeout, timing.Interval)
+		}
+	}
+	return timing, nil
+}
+
+const (
+	execProbeStrategyAnnotation = "exec-probe-strategy"
+	execProbePortAnnotation     = "exec-probe-port"
+	tcpCheckAnnotationPrefix    = "check-tcp-"
+	defaultExecProbePort        = 8099
+	execProbeShimPath           = "/.score-flyio/exec-probe.sh"
+)
+
+var (
+	execProbeStrategies = []string{"ignore", "shim"}
+	tcpCheckModes       = []string{"service", "machine"}
+)
+
+// addTcpChecks adds a tcp check for each port with a check-tcp-<port> annotation. The service mode adds the check to
+// the Fly Proxy service for the port while the machine mode adds a top-level machine check.
+func addTcpChecks(output *appconfig.AppConfig, ports map[string]scoretypes.ServicePort, workloadAnnotations map[string]interface{}) error {
+	for _, name := range slices.Sorted(maps.Keys(ports)) {
+		mode, _ := workloadAnnotations[annotationPrefix+tcpCheckAnnotationPrefix+name].(string)
+		if mode == "" {
+			continue
+		}
+		def := ports[name]
+		if def.Protocol != nil && *def.Protocol == scoretypes.ServicePortProtocolUDP {
+			return fmt.Errorf("services[%s]: tcp checks cannot be used with a udp port", name)
+		}
+		internalPort := internal.DerefOr(def.TargetPort, def.Port)
+		switch mode {
+		case "service":
+			i := slices.IndexFunc(output.Services, func(service appconfig.Service) bool {
+				return service.InternalPort == internalPort && service.Protocol == "tcp"
+			})
+			if i < 0 {
+				return fmt.Errorf("services[%s]: tcp service checks cannot be added to an http_service, use 'machine' instead", name)
+			} else if len(output.Services[i].TcpChecks) == 0 {
+				output.Services[i].TcpChecks = []appconfig.TcpCheck{{}}
+			}
+		case "machine":
+			if output.Checks == nil {
+				output.Checks = make(map[string]appconfig.TopLevelCheck)
+			}
+			output.Checks["tcp_"+name] = appconfig.TopLevelCheck{Type: "tcp", Port: internalPort}
+		}
+	}
+	return nil
+}
+
+// execProbeShimScript returns a shell script that serves each exec probe command as an http path on the given port
+// using netcat, before running the original command passed as arguments. The script exits early if the image is missing
+// any of the commands it needs, since the checks would otherwise fail without explanation.
+func execProbeShimScript(port int, probes map[string][]string) string {
+	sb := new(strings.Builder)
+	sb.WriteString("#!/bin/sh\n# generated by score-flyio to serve exec probes as http checks\n")
+	sb.WriteString("for c in nc mkfifo mktemp; do\n  command -v \"$c\" >/dev/null 2>&1 || { echo \"score-flyio: the exec probe shim requires $c in the image\" >&2; exit 1; }\ndone\n")
+	sb.WriteString("respond() {\n  read -r _ path _\n  case \"$path\" in\n")
+	for _, name := range slices.Sorted(maps.Keys(probes)) {
+		fmt.Fprintf(sb, "    /%s) %s >/dev/null 2>&1 ;;\n", name, shellJoin(probes[name]))
+	}
+	sb.WriteString("    *) false ;;\n  esac\n")
+	sb.WriteString("  if [ $? -eq 0 ]; then printf 'HTTP/1.0 200 OK\\r\\n\\r\\n'; else printf 'HTTP/1.0 503 Service Unavailable\\r\\n\\r\\n'; fi\n}\n")
+	fmt.Fprintf(sb, "serve() {\n  fifo=$(mktemp -u)\n  mkfifo \"$fifo\"\n  while true; do\n    nc -l -p %d < \"$fifo\" | respond > \"$fifo\"\n  done\n}\n", port)
+	sb.WriteString("serve &\nexec \"$@\"\n")
+	return sb.String()
+}
+
+// addExecProbeShim mounts the exec probe shim script and wraps the container command with it.
+func addExecProbeShim(output *appconfig.AppConfig, port int, probes map[string][]string) error {
+	return wrapEntrypoint(output, "the shim exec probe strategy", execProbeShimPath, execProbeShimScript(port, probes))
+}
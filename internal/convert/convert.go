@@ -21,18 +21,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"reflect"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/score-spec/score-go/framework"
 	scoretypes "github.com/score-spec/score-go/types"
 
+	"github.com/astromechza/score-flyio/internal"
 	"github.com/astromechza/score-flyio/internal/appconfig"
 	"github.com/astromechza/score-flyio/internal/provisioners"
 	"github.com/astromechza/score-flyio/internal/state"
@@ -47,30 +51,18 @@ func anyFromMap[k string, v any](in map[k]v) (k, v, bool) {
 	return kk, vv, false
 }
 
-func collateVmResources(cr scoretypes.ContainerResources) (cpus int, memory int64, err error) {
-	cpus = 1
-	mUnit := int64(256 * 1_000_000)
-	memory = mUnit
-	for _, rl := range []*scoretypes.ResourcesLimits{cr.Requests, cr.Limits} {
-		if rl != nil {
-			if c, m, err := scoretypes.ParseResourceLimits(*rl); err != nil {
-				return cpus, memory, fmt.Errorf("failed to parse resource: %w", err)
-			} else {
-				if c != nil {
-					cpus = max(cpus, int(math.Ceil(float64(*c)/1000)))
-				}
-				if m != nil {
-					memory = max(memory, int64(float64(mUnit)*math.Ceil(float64(*m)/float64(mUnit))))
-				}
-			}
-		}
-	}
-	return
-}
-
 const annotationPrefix = "score-flyio.astromechza.github.com/"
 
-var annotationReg = regexp.MustCompile(`^service-([^-]+)-(handlers|auto-stop|min-running|http-options|concurrency)$`)
+const (
+	configPatchAnnotation          = "fly-config-patch"
+	appGroupAnnotation             = "app-group"
+	deployStrategyAnnotation       = "deploy-strategy"
+	deployReleaseCommandAnnotation = "deploy-release-command"
+	deployMaxUnavailableAnnotation = "deploy-max-unavailable"
+	deployWaitTimeoutAnnotation    = "deploy-wait-timeout"
+)
+
+var deployStrategies = []string{"immediate", "rolling", "bluegreen", "canary"}
 
 func Workload(currentState *state.State, workloadName string) (*appconfig.AppConfig, map[string]string, error) {
 	resOutputs, err := currentState.GetResourceOutputForWorkload(workloadName)
@@ -81,17 +73,35 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 
 	workload := currentState.Workloads[workloadName]
 	workloadAnnotations, _ := workload.Spec.Metadata["annotations"].(map[string]interface{})
-	for s := range workloadAnnotations {
-		if strings.HasPrefix(s, annotationPrefix) {
-			if !annotationReg.MatchString(s[len(annotationPrefix):]) {
-				return nil, nil, fmt.Errorf("unrecognised %s annotation: '%s'", annotationPrefix, s)
+	placeholders := map[string][]string{portPlaceholder: nil, volumePlaceholder: nil}
+	if workload.Spec.Service != nil {
+		placeholders[portPlaceholder] = slices.Collect(maps.Keys(workload.Spec.Service.Ports))
+	}
+	volumeTargets := make(map[string]string)
+	for _, containerName := range slices.Sorted(maps.Keys(workload.Spec.Containers)) {
+		for _, volume := range workload.Spec.Containers[containerName].Volumes {
+			key := volumeKey(volume.Target)
+			if other, ok := volumeTargets[key]; ok && other != volume.Target && hasVolumeAnnotations(workloadAnnotations, key) {
+				return nil, nil, fmt.Errorf("annotations: volume targets '%s' and '%s' have the same key '%s' so their volume annotations are ambiguous", other, volume.Target, key)
 			}
+			volumeTargets[key] = volume.Target
+			placeholders[volumePlaceholder] = append(placeholders[volumePlaceholder], key)
 		}
 	}
+	if err := validateAnnotations(workloadAnnotations, placeholders); err != nil {
+		return nil, nil, fmt.Errorf("annotations: %w", err)
+	}
+	private, err := AppPrivate(currentState, []string{workloadName})
+	if err != nil {
+		return nil, nil, err
+	}
 	output := &appconfig.AppConfig{
 		AppName: currentState.Extras.AppPrefix + workloadName,
 		Build:   &appconfig.Build{},
 	}
+	if output.PrimaryRegion, err = primaryRegion(currentState, workloadName); err != nil {
+		return nil, nil, err
+	}
 
 	outputSecrets := make(map[string]string)
 
@@ -99,11 +109,17 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 		return nil, nil, fmt.Errorf("containers: only 1 container per workload is supported until Fly multi-container support is released")
 	}
 	containerName, container, _ := anyFromMap(workload.Spec.Containers)
-	if container.Image == "." {
+	if bo, err := buildOptions(workloadAnnotations); err != nil {
+		return nil, nil, err
+	} else if container.Image == "." {
 		if f := currentState.Workloads[workloadName].File; f != nil {
 			output.Build.Dockerfile = filepath.Join(filepath.Dir(*f), "Dockerfile")
 			output.Build.IgnoreFile = filepath.Join(filepath.Dir(*f), ".dockerignore")
 		}
+		// build secrets can only be used with generate --build since Fly remote builders take them as deploy flags
+		output.Build.Args, output.Build.BuildTarget = bo.Args, bo.Target
+	} else if pinned, ok := workload.Extras.PinnedImages[containerName]; ok {
+		output.Build.Image = pinned
 	} else {
 		output.Build.Image = container.Image
 	}
@@ -120,12 +136,10 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 		}
 		output.Experimental.Cmd = container.Args
 	}
-	if container.Resources != nil {
-		c, m, err := collateVmResources(*container.Resources)
-		if err != nil {
-			return nil, nil, fmt.Errorf("resources: %w", err)
-		}
-		output.Vm = &appconfig.Vm{Cpus: c, Memory: fmt.Sprintf("%dMB", int(m/1000000))}
+	if vm, err := buildVm(container.Resources, workloadAnnotations); err != nil {
+		return nil, nil, fmt.Errorf("resources: %w", err)
+	} else if vm != nil {
+		output.Vm = vm
 	}
 
 	if len(container.Variables) > 0 {
@@ -144,11 +158,24 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 			}
 		}
 	}
+	var shim *initShim
+	if v, _ := workloadAnnotations[annotationPrefix+initShimAnnotation].(string); v != "" {
+		if b, err := strconv.ParseBool(v); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse init shim '%s' as bool: %w", v, err)
+		} else if b {
+			shim = new(initShim)
+		}
+	}
+
 	if len(container.Files) > 0 {
 		output.Files = make([]appconfig.File, 0, len(container.Files))
 		for i, f := range container.Files {
-			if f.Mode != nil {
-				return nil, nil, fmt.Errorf("container[%s].files[%d]: mode not supported", containerName, i)
+			if f.Mode != nil && shim == nil {
+				return nil, nil, fmt.Errorf("container[%s].files[%d]: mode not supported without the %s annotation", containerName, i, initShimAnnotation)
+			} else if f.Mode != nil {
+				if err := shim.chmod(f.Target, *f.Mode); err != nil {
+					return nil, nil, fmt.Errorf("container[%s].files[%d]: %w", containerName, i, err)
+				}
 			}
 			if f.Source != nil {
 				if !filepath.IsAbs(*f.Source) && workload.File != nil {
@@ -208,22 +235,59 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 	if len(container.Volumes) > 0 {
 		output.Mounts = make([]appconfig.Mount, 0, len(container.Volumes))
 		for i, volume := range container.Volumes {
-			if volume.Path != nil && *volume.Path != "/" {
-				return nil, nil, fmt.Errorf("container[%s].volumes[%d]: sub-path is not supported", containerName, i)
-			} else if volume.ReadOnly != nil && *volume.ReadOnly {
-				return nil, nil, fmt.Errorf("container[%s].volumes[%d]: read-only=true is not supported", containerName, i)
+			subPath := path.Clean("/" + internal.DerefOr(volume.Path, "/"))
+			readOnly := internal.DerefOr(volume.ReadOnly, false)
+			if subPath != "/" && shim == nil {
+				return nil, nil, fmt.Errorf("container[%s].volumes[%d]: sub-path is not supported without the %s annotation", containerName, i, initShimAnnotation)
+			} else if readOnly && shim == nil {
+				return nil, nil, fmt.Errorf("container[%s].volumes[%d]: read-only=true is not supported without the %s annotation", containerName, i, initShimAnnotation)
 			}
 			source := volume.Source
 			if source, err = framework.SubstituteString(source, sf); err != nil {
 				return nil, nil, fmt.Errorf("container[%s].volumes[%d]: failed to interpolate source: %w", containerName, i, err)
 			}
-			output.Mounts = append(output.Mounts, appconfig.Mount{Source: source, Destination: volume.Target})
+			mount := appconfig.Mount{Source: source, Destination: volume.Target}
+			if subPath != "/" || readOnly {
+				// the volume is mounted once in a hidden directory and each sub-path is linked into place by the shim
+				mount.Destination = path.Join(initShimVolumesDir, source)
+				shim.link(mount.Destination, subPath, volume.Target, readOnly)
+				if slices.ContainsFunc(output.Mounts, func(m appconfig.Mount) bool { return m.Destination == mount.Destination }) {
+					if hasVolumeAnnotations(workloadAnnotations, volumeKey(volume.Target)) {
+						return nil, nil, fmt.Errorf("container[%s].volumes[%d]: volume annotations for '%s' cannot be applied since the mount of source '%s' is shared with an earlier volume, set them for the first volume target instead", containerName, i, volumeKey(volume.Target), source)
+					}
+					continue
+				}
+			}
+			if err := applyVolumeSettings(&mount, volume.Target, volume.Source, resOutputs, workloadAnnotations); err != nil {
+				return nil, nil, fmt.Errorf("container[%s].volumes[%d]: %w", containerName, i, err)
+			}
+			output.Mounts = append(output.Mounts, mount)
 		}
 	}
 
+	var servicePorts map[string]scoretypes.ServicePort
+	if workload.Spec.Service != nil {
+		servicePorts = workload.Spec.Service.Ports
+	}
+	metrics, err := buildMetrics(servicePorts, workloadAnnotations)
+	if err != nil {
+		return nil, nil, fmt.Errorf("metrics: %w", err)
+	} else if metrics != nil {
+		output.Metrics = []appconfig.Metrics{*metrics}
+	}
+
 	output.Services = make([]appconfig.Service, 0)
+	// serviceNames holds the score port names that were merged into each of the output services
+	serviceNames := make([][]string, 0)
 	if workload.Spec.Service != nil {
-		for name, def := range workload.Spec.Service.Ports {
+		for _, name := range slices.Sorted(maps.Keys(workload.Spec.Service.Ports)) {
+			def := workload.Spec.Service.Ports[name]
+			if metrics != nil && !private && name == metricsPortName && internal.DerefOr(def.TargetPort, def.Port) == metrics.Port {
+				// metrics are scraped over the private network, so a port dedicated to them must not be exposed on
+				// the public ips. Ports that share the metrics target port with other traffic are still exposed.
+				slog.Info("Not exposing the dedicated metrics port as a public service", slog.String("port", name))
+				continue
+			}
 			svc := appconfig.Service{
 				InternalPort: def.Port,
 				Protocol:     "tcp",
@@ -268,22 +332,73 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 				}
 				svc.Concurrency = concurrency
 			}
+
+			// ports that share a target port and protocol are exposed through the same service
+			if i := slices.IndexFunc(output.Services, func(existing appconfig.Service) bool {
+				return existing.InternalPort == svc.InternalPort && existing.Protocol == svc.Protocol
+			}); i >= 0 {
+				if err := checkSharedServiceAnnotations(workloadAnnotations, name, serviceNames[i]); err != nil {
+					return nil, nil, fmt.Errorf("services[%s]: %w", name, err)
+				}
+				existing := &output.Services[i]
+				existing.Ports = append(existing.Ports, svc.Ports...)
+				if existing.AutoStopMachines == "" {
+					existing.AutoStopMachines, existing.AutoStartMachines = svc.AutoStopMachines, svc.AutoStartMachines
+				}
+				if existing.MinMachinesRunning == 0 {
+					existing.MinMachinesRunning = svc.MinMachinesRunning
+				}
+				if existing.Concurrency == nil {
+					existing.Concurrency = svc.Concurrency
+				}
+				serviceNames[i] = append(serviceNames[i], name)
+				continue
+			}
 			output.Services = append(output.Services, svc)
+			serviceNames = append(serviceNames, []string{name})
 		}
 	}
 
 	machineChecks := make(map[string]appconfig.TopLevelCheck)
+	livenessTiming, err := buildCheckTiming(workloadAnnotations, livenessProbe)
+	if err != nil {
+		return nil, nil, fmt.Errorf("container[%s].livenessProbe: %w", containerName, err)
+	}
+	readinessTiming, err := buildCheckTiming(workloadAnnotations, readinessProbe)
+	if err != nil {
+		return nil, nil, fmt.Errorf("container[%s].readinessProbe: %w", containerName, err)
+	}
+	execProbeStrategy, _ := workloadAnnotations[annotationPrefix+execProbeStrategyAnnotation].(string)
+	execProbePort := defaultExecProbePort
+	if v, _ := workloadAnnotations[annotationPrefix+execProbePortAnnotation].(string); v != "" {
+		if execProbePort, err = strconv.Atoi(v); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse exec probe port '%s' as int: %w", v, err)
+		}
+	}
+	execProbes := make(map[string][]string)
 	if container.LivenessProbe != nil {
-		if container.LivenessProbe.Exec != nil {
-			slog.Warn("Exec probes are not supported, ignoring it in the livenessProbes")
+		if container.LivenessProbe.Exec != nil && execProbeStrategy == "shim" {
+			execProbes[livenessProbe] = container.LivenessProbe.Exec.Command
+			machineChecks["liveness_probe"] = appconfig.TopLevelCheck{
+				Type: "http", Port: execProbePort, Method: "get", Path: "/liveness",
+				GracePeriod: livenessTiming.GracePeriod, Interval: livenessTiming.Interval, Timeout: livenessTiming.Timeout,
+			}
+		} else if container.LivenessProbe.Exec != nil {
+			slog.Warn("Exec probes are not supported without the shim exec probe strategy, ignoring it in the livenessProbes")
 		}
 		if container.LivenessProbe.HttpGet != nil {
-			machineChecks["liveness_probe"] = httpProbeToMachineCheck(*container.LivenessProbe.HttpGet)
+			machineChecks["liveness_probe"] = httpProbeToMachineCheck(*container.LivenessProbe.HttpGet, livenessTiming)
 		}
 	}
 	if container.ReadinessProbe != nil {
-		if container.ReadinessProbe.Exec != nil {
-			slog.Warn("Exec probes are not supported, ignoring it in the readinessProbe")
+		if container.ReadinessProbe.Exec != nil && execProbeStrategy == "shim" {
+			execProbes[readinessProbe] = container.ReadinessProbe.Exec.Command
+			machineChecks["readiness_probe"] = appconfig.TopLevelCheck{
+				Type: "http", Port: execProbePort, Method: "get", Path: "/readiness",
+				GracePeriod: readinessTiming.GracePeriod, Interval: readinessTiming.Interval, Timeout: readinessTiming.Timeout,
+			}
+		} else if container.ReadinessProbe.Exec != nil {
+			slog.Warn("Exec probes are not supported without the shim exec probe strategy, ignoring it in the readinessProbe")
 		}
 		if container.ReadinessProbe.HttpGet != nil {
 			hg := container.ReadinessProbe.HttpGet
@@ -291,10 +406,10 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 				return service.InternalPort == hg.Port
 			})
 			if foundSvcIndex == -1 {
-				machineChecks["readiness_probe"] = httpProbeToMachineCheck(*container.ReadinessProbe.HttpGet)
+				machineChecks["readiness_probe"] = httpProbeToMachineCheck(*container.ReadinessProbe.HttpGet, readinessTiming)
 			} else {
 				svc := output.Services[foundSvcIndex]
-				svc.HttpChecks = []appconfig.HttpCheck{httpProbeToHttpCheck(*container.ReadinessProbe.HttpGet)}
+				svc.HttpChecks = []appconfig.HttpCheck{httpProbeToHttpCheck(*container.ReadinessProbe.HttpGet, readinessTiming)}
 				output.Services[foundSvcIndex] = svc
 			}
 		}
@@ -302,15 +417,232 @@ func Workload(currentState *state.State, workloadName string) (*appconfig.AppCon
 	if len(machineChecks) > 0 {
 		output.Checks = machineChecks
 	}
+	if len(execProbes) > 0 {
+		if err := addExecProbeShim(output, execProbePort, execProbes); err != nil {
+			return nil, nil, fmt.Errorf("container[%s]: %w", containerName, err)
+		}
+	}
+	if shim != nil {
+		if err := shim.apply(output); err != nil {
+			return nil, nil, fmt.Errorf("container[%s]: %w", containerName, err)
+		}
+	}
+
+	if workload.Spec.Service != nil {
+		if len(output.Services) == 1 {
+			if output.HttpService, err = buildHttpService(output.Services[0], serviceNames[0], workloadAnnotations); err != nil {
+				return nil, nil, fmt.Errorf("services[%s]: %w", strings.Join(serviceNames[0], ","), err)
+			} else if output.HttpService != nil {
+				output.Services = make([]appconfig.Service, 0)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(workload.Spec.Service.Ports)) {
+			if _, ok := workloadAnnotations[fmt.Sprintf("%sservice-%s-force-https", annotationPrefix, name)]; ok && output.HttpService == nil {
+				return nil, nil, fmt.Errorf("services[%s]: force-https can only be used when the port is converted into an http_service", name)
+			}
+		}
+	}
+
+	if workload.Spec.Service != nil {
+		if err := addTcpChecks(output, workload.Spec.Service.Ports, workloadAnnotations); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if output.Statics, err = buildStatics(container, workloadAnnotations); err != nil {
+		return nil, nil, err
+	}
+
+	if err := applyRuntimeAnnotations(output, workloadAnnotations); err != nil {
+		return nil, nil, err
+	}
+
+	if output.Deploy, err = buildDeploy(workloadAnnotations, sf, outputSecrets); err != nil {
+		return nil, nil, fmt.Errorf("deploy: %w", err)
+	} else if output.Deploy != nil && (output.Deploy.Strategy == "bluegreen" || output.Deploy.Strategy == "canary") {
+		if len(output.Mounts) > 0 {
+			return nil, nil, fmt.Errorf("deploy: the %s strategy cannot be used with volume mounts", output.Deploy.Strategy)
+		} else if output.Deploy.Strategy == "bluegreen" && len(output.Checks) == 0 && !slices.ContainsFunc(output.Services, func(service appconfig.Service) bool {
+			return len(service.HttpChecks) > 0
+		}) && (output.HttpService == nil || len(output.HttpService.Checks) == 0) {
+			return nil, nil, fmt.Errorf("deploy: the bluegreen strategy requires a liveness or readiness probe")
+		}
+	}
 	return output, outputSecrets, nil
 }
 
-func httpProbeToMachineCheck(probe scoretypes.HttpProbe) appconfig.TopLevelCheck {
+// buildDeploy converts the deploy annotations into the deploy section. Any secrets accessed by the release command are
+// exposed as runtime secrets and referenced through environment variables in a shell wrapper.
+func buildDeploy(workloadAnnotations map[string]interface{}, sf func(string) (string, error), outputSecrets map[string]string) (*appconfig.Deploy, error) {
+	deploy := new(appconfig.Deploy)
+	if v, _ := workloadAnnotations[annotationPrefix+deployStrategyAnnotation].(string); v != "" {
+		if !slices.Contains(deployStrategies, v) {
+			return nil, fmt.Errorf("strategy '%s' is not one of %v", v, deployStrategies)
+		}
+		deploy.Strategy = v
+	}
+	if v, _ := workloadAnnotations[annotationPrefix+deployMaxUnavailableAnnotation].(string); v != "" {
+		if fv, err := strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse max unavailable '%s' as a number: %w", v, err)
+		} else if fv <= 0 || (fv > 1 && fv != math.Trunc(fv)) {
+			return nil, fmt.Errorf("max unavailable '%s' must be a fraction between 0 and 1 or a whole number of machines", v)
+		} else {
+			deploy.MaxUnavailable = &fv
+		}
+	}
+	if v, _ := workloadAnnotations[annotationPrefix+deployWaitTimeoutAnnotation].(string); v != "" {
+		if d, err := time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("failed to parse wait timeout '%s' as a duration: %w", v, err)
+		} else if d <= 0 {
+			return nil, fmt.Errorf("wait timeout '%s' must be positive", v)
+		}
+		deploy.WaitTimeout = v
+	}
+	if v, _ := workloadAnnotations[annotationPrefix+deployReleaseCommandAnnotation].(string); v != "" {
+		// secrets are passed as runtime secrets through a shell, so every interpolated value is quoted in case the
+		// command needs to be wrapped
+		var secretNames []string
+		shellOut, err := framework.SubstituteString(v, func(ref string) (string, error) {
+			sf2, sa := provisioners.BuildSubstitutionFuncWithSecretWatch(sf)
+			value, err := sf2(ref)
+			if err != nil {
+				return "", err
+			} else if !*sa {
+				return shellQuote(value), nil
+			}
+			name := fmt.Sprintf("RELEASE_COMMAND_SECRET_%d", len(secretNames))
+			secretNames = append(secretNames, name)
+			outputSecrets[name] = value
+			return `"${` + name + `}"`, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to interpolate release command: %w", err)
+		}
+		if len(secretNames) > 0 {
+			slog.Warn("Secret accessed as part of resolving the release command, passing it as a runtime secret through a shell", slog.Any("secrets", secretNames))
+			deploy.ReleaseCommand = "/bin/sh -c " + shellQuote(shellOut)
+		} else if deploy.ReleaseCommand, err = framework.SubstituteString(v, sf); err != nil {
+			return nil, fmt.Errorf("failed to interpolate release command: %w", err)
+		}
+	}
+	if *deploy == (appconfig.Deploy{}) {
+		return nil, nil
+	}
+	return deploy, nil
+}
+
+// sharedServiceAnnotations are the service level annotations that must agree between ports that share a service.
+var sharedServiceAnnotations = []string{"auto-stop", "min-running", "concurrency", "http", "force-https"}
+
+// checkSharedServiceAnnotations returns an error if the port sets a service level annotation to a value that
+// contradicts one of the other ports that share the same service.
+func checkSharedServiceAnnotations(workloadAnnotations map[string]interface{}, name string, others []string) error {
+	for _, suffix := range sharedServiceAnnotations {
+		v, _ := workloadAnnotations[fmt.Sprintf("%sservice-%s-%s", annotationPrefix, name, suffix)].(string)
+		if v == "" {
+			continue
+		}
+		for _, other := range others {
+			if ov, _ := workloadAnnotations[fmt.Sprintf("%sservice-%s-%s", annotationPrefix, other, suffix)].(string); ov != "" && ov != v {
+				return fmt.Errorf("%s '%s' contradicts '%s' on port '%s' which shares the same target port", suffix, v, ov, other)
+			}
+		}
+	}
+	return nil
+}
+
+// serviceAnnotation returns the first non-empty value of the service annotation across the given port names.
+func serviceAnnotation(workloadAnnotations map[string]interface{}, names []string, suffix string) string {
+	for _, name := range names {
+		if v, _ := workloadAnnotations[fmt.Sprintf("%sservice-%s-%s", annotationPrefix, name, suffix)].(string); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ServiceHttp returns true if the http annotation of the service port is explicitly set to true.
+func ServiceHttp(workloadAnnotations map[string]interface{}, portName string) bool {
+	v, _ := strconv.ParseBool(serviceAnnotation(workloadAnnotations, []string{portName}, "http"))
+	return v
+}
+
+// buildHttpService converts the service into an http_service if the http annotation is true, or if it is not set and
+// the ports are exactly what an http_service exposes: 80 with the http handler and 443 with the tls and http handlers.
+// A lone 443 port is also converted when force-https is set since port 80 then only redirects. Returns nil if the
+// service should remain a raw service.
+func buildHttpService(svc appconfig.Service, names []string, workloadAnnotations map[string]interface{}) (*appconfig.HttpService, error) {
+	forceHttps := false
+	if v := serviceAnnotation(workloadAnnotations, names, "force-https"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse force-https '%s' as bool: %w", v, err)
+		}
+		forceHttps = b
+	}
+	standard := svc.Protocol == "tcp" && isHttpServicePorts(svc.Ports, forceHttps)
+	useHttpService := standard
+	if v := serviceAnnotation(workloadAnnotations, names, "http"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse http '%s' as bool: %w", v, err)
+		} else if b && svc.Protocol != "tcp" {
+			return nil, fmt.Errorf("http cannot be used with a udp port")
+		}
+		useHttpService = b
+	}
+	if !useHttpService {
+		return nil, nil
+	} else if !standard {
+		slog.Warn("The http_service always listens on ports 80 and 443 instead of the declared service ports", slog.Any("ports", names))
+	}
+	hs := &appconfig.HttpService{
+		AutoStartMachines:  svc.AutoStartMachines,
+		AutoStopMachines:   svc.AutoStopMachines,
+		Checks:             svc.HttpChecks,
+		Concurrency:        svc.Concurrency,
+		InternalPort:       svc.InternalPort,
+		MinMachinesRunning: svc.MinMachinesRunning,
+	}
+	for _, port := range svc.Ports {
+		if port.HttpOptions == nil {
+			continue
+		} else if hs.HttpOptions != nil && !reflect.DeepEqual(hs.HttpOptions, port.HttpOptions) {
+			return nil, fmt.Errorf("ports have different http options and cannot be merged into an http_service")
+		}
+		hs.HttpOptions = port.HttpOptions
+	}
+	hs.ForceHttps = forceHttps
+	return hs, nil
+}
+
+// isHttpServicePorts returns true if the ports are exactly 80 with the http handler and 443 with the tls and http
+// handlers, or only the 443 port if plain http requests are redirected to https.
+func isHttpServicePorts(ports []appconfig.ServicePort, forceHttps bool) bool {
+	var hasHttp, hasHttps bool
+	for _, port := range ports {
+		handlers := slices.Sorted(slices.Values(port.Handlers))
+		switch {
+		case port.Port == 80 && slices.Equal(handlers, []string{"http"}) && !hasHttp:
+			hasHttp = true
+		case port.Port == 443 && slices.Equal(handlers, []string{"http", "tls"}) && !hasHttps:
+			hasHttps = true
+		default:
+			return false
+		}
+	}
+	return hasHttps && (hasHttp || forceHttps)
+}
+
+func httpProbeToMachineCheck(probe scoretypes.HttpProbe, timing checkTiming) appconfig.TopLevelCheck {
 	check := appconfig.TopLevelCheck{
-		Type:   "http",
-		Port:   probe.Port,
-		Method: "get",
-		Path:   probe.Path,
+		Type:        "http",
+		Port:        probe.Port,
+		Method:      "get",
+		Path:        probe.Path,
+		GracePeriod: timing.GracePeriod,
+		Interval:    timing.Interval,
+		Timeout:     timing.Timeout,
 	}
 	if probe.HttpHeaders != nil {
 		headers := make(map[string]string, len(probe.HttpHeaders))
@@ -322,10 +654,13 @@ func httpProbeToMachineCheck(probe scoretypes.HttpProbe) appconfig.TopLevelCheck
 	return check
 }
 
-func httpProbeToHttpCheck(probe scoretypes.HttpProbe) appconfig.HttpCheck {
+func httpProbeToHttpCheck(probe scoretypes.HttpProbe, timing checkTiming) appconfig.HttpCheck {
 	check := appconfig.HttpCheck{
-		Method: "get",
-		Path:   probe.Path,
+		Method:      "get",
+		Path:        probe.Path,
+		GracePeriod: timing.GracePeriod,
+		Interval:    timing.Interval,
+		Timeout:     timing.Timeout,
 	}
 	if probe.Scheme != nil {
 		check.Protocol = strings.ToLower(string(*probe.Scheme))
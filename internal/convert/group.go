@@ -0,0 +1,181 @@
+package convert
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/astromechza/score-flyio/internal/appconfig"
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+// AppGroup returns the app group that the workload belongs to, or an empty string if the workload is its own app.
+func AppGroup(currentState *state.State, workloadName string) string {
+	workloadAnnotations, _ := currentState.Workloads[workloadName].Spec.Metadata["annotations"].(map[string]interface{})
+	v, _ := workloadAnnotations[annotationPrefix+appGroupAnnotation].(string)
+	return v
+}
+
+// AppName returns the Fly app name that the workload is deployed into.
+func AppName(currentState *state.State, workloadName string) string {
+	if group := AppGroup(currentState, workloadName); group != "" {
+		return currentState.Extras.AppPrefix + group
+	}
+	return currentState.Extras.AppPrefix + workloadName
+}
+
+// GroupWorkloads returns the sorted names of the workloads in the given app group.
+func GroupWorkloads(currentState *state.State, group string) []string {
+	out := make([]string, 0)
+	for _, name := range slices.Sorted(maps.Keys(currentState.Workloads)) {
+		if AppGroup(currentState, name) == group {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// WorkloadGroup converts each workload in the app group and merges them into a single app where each workload is a
+// process group. Workloads must agree on the image, entrypoint, environment, secrets, and deploy settings.
+func WorkloadGroup(currentState *state.State, group string) (*appconfig.AppConfig, map[string]string, error) {
+	output := &appconfig.AppConfig{
+		AppName:   currentState.Extras.AppPrefix + group,
+		Processes: make(map[string]string),
+		Services:  make([]appconfig.Service, 0),
+	}
+	if _, err := AppPrivate(currentState, GroupWorkloads(currentState, group)); err != nil {
+		return nil, nil, err
+	}
+	outputSecrets := make(map[string]string)
+	var first string
+	var entrypoint []string
+	var vms []appconfig.Vm
+	for _, workloadName := range GroupWorkloads(currentState, group) {
+		cfg, secrets, err := Workload(currentState, workloadName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", workloadName, err)
+		}
+		processes := []string{workloadName}
+
+		var cmd []string
+		var workloadEntrypoint []string
+		if cfg.Experimental != nil {
+			cmd, workloadEntrypoint = cfg.Experimental.Cmd, cfg.Experimental.Entrypoint
+		}
+		if first == "" {
+			first = workloadName
+			output.Build = cfg.Build
+			output.Deploy = cfg.Deploy
+			output.KillSignal, output.KillTimeout, output.SwapSizeMb = cfg.KillSignal, cfg.KillTimeout, cfg.SwapSizeMb
+			output.PrimaryRegion = cfg.PrimaryRegion
+			entrypoint = workloadEntrypoint
+		} else if !reflect.DeepEqual(output.Build, cfg.Build) {
+			return nil, nil, fmt.Errorf("workloads '%s' and '%s' in app group '%s' have conflicting images", first, workloadName, group)
+		} else if !reflect.DeepEqual(output.Deploy, cfg.Deploy) {
+			return nil, nil, fmt.Errorf("workloads '%s' and '%s' in app group '%s' have conflicting deploy annotations", first, workloadName, group)
+		} else if output.KillSignal != cfg.KillSignal || output.KillTimeout != cfg.KillTimeout || !reflect.DeepEqual(output.SwapSizeMb, cfg.SwapSizeMb) {
+			return nil, nil, fmt.Errorf("workloads '%s' and '%s' in app group '%s' have conflicting kill or swap annotations", first, workloadName, group)
+		} else if output.PrimaryRegion != cfg.PrimaryRegion {
+			return nil, nil, fmt.Errorf("workloads '%s' and '%s' in app group '%s' have conflicting primary regions", first, workloadName, group)
+		} else if !slices.Equal(entrypoint, workloadEntrypoint) {
+			return nil, nil, fmt.Errorf("workloads '%s' and '%s' in app group '%s' have conflicting container commands", first, workloadName, group)
+		}
+		if len(cmd) == 0 {
+			// an empty process command does not fall back to the image command, so each process group must have args
+			return nil, nil, fmt.Errorf("workload '%s' in app group '%s' has no container args, but each process group requires a command", workloadName, group)
+		}
+		output.Processes[workloadName] = shellJoin(cmd)
+
+		for k, v := range cfg.Env {
+			if existing, ok := output.Env[k]; ok && existing != v {
+				return nil, nil, fmt.Errorf("workload '%s' in app group '%s' has a conflicting value for variable '%s'", workloadName, group, k)
+			} else if output.Env == nil {
+				output.Env = make(map[string]string)
+			}
+			output.Env[k] = v
+		}
+		for k, v := range secrets {
+			if existing, ok := outputSecrets[k]; ok && existing != v {
+				return nil, nil, fmt.Errorf("workload '%s' in app group '%s' has a conflicting value for secret '%s'", workloadName, group, k)
+			}
+			outputSecrets[k] = v
+		}
+		for _, f := range cfg.Files {
+			f.Processes = processes
+			output.Files = append(output.Files, f)
+		}
+		for _, m := range cfg.Mounts {
+			m.Processes = processes
+			output.Mounts = append(output.Mounts, m)
+		}
+		for _, svc := range cfg.Services {
+			svc.Processes = processes
+			output.Services = append(output.Services, svc)
+		}
+		if cfg.HttpService != nil {
+			if output.HttpService != nil {
+				return nil, nil, fmt.Errorf("workloads '%s' and '%s' in app group '%s' both have an http service", first, workloadName, group)
+			}
+			output.HttpService = cfg.HttpService
+			output.HttpService.Processes = processes
+		}
+		for _, metrics := range cfg.Metrics {
+			metrics.Processes = processes
+			output.Metrics = append(output.Metrics, metrics)
+		}
+		for _, static := range cfg.Statics {
+			static.Processes = processes
+			output.Statics = append(output.Statics, static)
+		}
+		for _, restart := range cfg.Restart {
+			restart.Processes = processes
+			output.Restart = append(output.Restart, restart)
+		}
+		if vm, ok := cfg.Vm.(*appconfig.Vm); ok {
+			vm.Processes = processes
+			vms = append(vms, *vm)
+		}
+		for name, check := range cfg.Checks {
+			check.Processes = processes
+			if output.Checks == nil {
+				output.Checks = make(map[string]appconfig.TopLevelCheck)
+			}
+			output.Checks[workloadName+"_"+name] = check
+		}
+	}
+	if first == "" {
+		return nil, nil, fmt.Errorf("app group '%s' has no workloads", group)
+	}
+	if len(vms) > 0 {
+		output.Vm = vms
+	}
+	if len(entrypoint) > 0 {
+		output.Experimental = &appconfig.Experimental{Entrypoint: entrypoint}
+	}
+	return output, outputSecrets, nil
+}
+
+// shellSafeReg matches arguments that the shell passes through unchanged and which therefore do not need quoting.
+var shellSafeReg = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellJoin joins the arguments into a single command string, quoting any arguments that contain whitespace, quotes,
+// or other characters that the shell would interpret.
+func shellJoin(args []string) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		if !shellSafeReg.MatchString(arg) {
+			parts[i] = shellQuote(arg)
+		} else {
+			parts[i] = arg
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// shellQuote wraps the value in single quotes so that the shell does not interpret any of it.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
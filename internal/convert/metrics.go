@@ -0,0 +1,53 @@
+package convert
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	scoretypes "github.com/score-spec/score-go/types"
+
+	"github.com/astromechza/score-flyio/internal"
+	"github.com/astromechza/score-flyio/internal/appconfig"
+)
+
+const (
+	metricsPortAnnotation = "metrics-port"
+	metricsPathAnnotation = "metrics-path"
+	metricsPortName       = "metrics"
+	defaultMetricsPath    = "/metrics"
+)
+
+// buildMetrics returns the Prometheus metrics scrape target from the metrics annotations, or from the target port of
+// a service port named metrics by convention. Returns nil if neither is set.
+func buildMetrics(ports map[string]scoretypes.ServicePort, workloadAnnotations map[string]interface{}) (*appconfig.Metrics, error) {
+	targetPorts := make([]int, 0, len(ports))
+	for _, def := range ports {
+		targetPorts = append(targetPorts, internal.DerefOr(def.TargetPort, def.Port))
+	}
+	metrics := &appconfig.Metrics{Path: defaultMetricsPath}
+	if v, _ := workloadAnnotations[annotationPrefix+metricsPortAnnotation].(string); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse port '%s' as int: %w", v, err)
+		} else if !slices.Contains(targetPorts, port) {
+			return nil, fmt.Errorf("port %d does not match the target port of any service port", port)
+		}
+		metrics.Port = port
+	} else if def, ok := ports[metricsPortName]; ok {
+		metrics.Port = internal.DerefOr(def.TargetPort, def.Port)
+	}
+	if v, _ := workloadAnnotations[annotationPrefix+metricsPathAnnotation].(string); v != "" {
+		if metrics.Port == 0 {
+			return nil, fmt.Errorf("path requires the %s annotation or a service port named '%s'", metricsPortAnnotation, metricsPortName)
+		} else if !strings.HasPrefix(v, "/") {
+			return nil, fmt.Errorf("path '%s' must start with /", v)
+		}
+		metrics.Path = v
+	}
+	if metrics.Port == 0 {
+		return nil, nil
+	}
+	return metrics, nil
+}
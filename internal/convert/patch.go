@@ -0,0 +1,62 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/astromechza/score-flyio/internal"
+	"github.com/astromechza/score-flyio/internal/appconfig"
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+// WorkloadConfigPatch returns the content of the fly-config-patch annotation on the workload if it is set.
+func WorkloadConfigPatch(currentState *state.State, workloadName string) string {
+	workloadAnnotations, _ := currentState.Workloads[workloadName].Spec.Metadata["annotations"].(map[string]interface{})
+	v, _ := workloadAnnotations[annotationPrefix+configPatchAnnotation].(string)
+	return v
+}
+
+// PatchConfig applies each patch to the config in order. A patch that is an object is applied as a JSON Merge Patch
+// while a patch that is an array is applied as a JSON Patch. Patches may be written in JSON or YAML. If there are no
+// patches, the config is returned unmodified so that the encoded output retains the struct field order.
+func PatchConfig(config *appconfig.AppConfig, patches ...string) (interface{}, error) {
+	if len(patches) == 0 {
+		return config, nil
+	}
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	for i, patch := range patches {
+		trimmed := bytes.TrimSpace([]byte(patch))
+		if bytes.HasPrefix(trimmed, []byte("[")) || bytes.HasPrefix(trimmed, []byte("- ")) {
+			var operations []internal.JsonPatchOperation
+			if err := yaml.Unmarshal(trimmed, &operations); err != nil {
+				return nil, fmt.Errorf("patch %d: failed to decode json patch: %w", i, err)
+			} else if doc, err = internal.ApplyJsonPatch(doc, operations); err != nil {
+				return nil, fmt.Errorf("patch %d: failed to apply json patch: %w", i, err)
+			}
+		} else {
+			var mergePatch map[string]interface{}
+			if err := yaml.Unmarshal(trimmed, &mergePatch); err != nil {
+				return nil, fmt.Errorf("patch %d: failed to decode merge patch: %w", i, err)
+			}
+			docMap, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("patch %d: cannot apply a merge patch to a non-object config", i)
+			}
+			doc = internal.PatchMap(docMap, mergePatch)
+		}
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("patched config is not an object")
+	}
+	return doc, nil
+}
@@ -0,0 +1,43 @@
+package convert
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+const privateServiceSuffix = "private"
+
+// AppPrivate returns true if the service ports of the given workloads are private-only and should only be reachable
+// through a Flycast private ip. Each port uses the service-<port>-private annotation, falling back to the project
+// default. Since ips are allocated per app, all ports of the workloads must agree.
+func AppPrivate(currentState *state.State, workloadNames []string) (bool, error) {
+	var private *bool
+	var first string
+	for _, workloadName := range workloadNames {
+		spec := currentState.Workloads[workloadName].Spec
+		if spec.Service == nil {
+			continue
+		}
+		workloadAnnotations, _ := spec.Metadata["annotations"].(map[string]interface{})
+		for _, name := range slices.Sorted(maps.Keys(spec.Service.Ports)) {
+			portPrivate := currentState.Extras.PrivateServices
+			if v, _ := workloadAnnotations[fmt.Sprintf("%sservice-%s-%s", annotationPrefix, name, privateServiceSuffix)].(string); v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return false, fmt.Errorf("services[%s]: failed to parse private '%s' as bool: %w", name, v, err)
+				}
+				portPrivate = b
+			}
+			if private == nil {
+				private, first = &portPrivate, workloadName+"."+name
+			} else if *private != portPrivate {
+				return false, fmt.Errorf("service ports '%s' and '%s' mix private and public services, but ips are allocated per app", first, workloadName+"."+name)
+			}
+		}
+	}
+	return private != nil && *private, nil
+}
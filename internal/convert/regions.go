@@ -0,0 +1,72 @@
+package convert
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+const regionsAnnotation = "regions"
+
+var regionReg = regexp.MustCompile(`^[a-z]{3}$`)
+
+// RegionCount is the number of machines to run in a Fly region.
+type RegionCount struct {
+	Region string
+	Count  int
+}
+
+// IsRegion returns true if the value looks like a Fly region code.
+func IsRegion(value string) bool {
+	return regionReg.MatchString(value)
+}
+
+// parseRegions parses a comma-separated list of regions where each region may be followed by =<count>. The count
+// defaults to 1 and the first region is the primary region.
+func parseRegions(value string) ([]RegionCount, error) {
+	out := make([]RegionCount, 0)
+	for _, part := range strings.Split(value, ",") {
+		region, rawCount, hasCount := strings.Cut(strings.TrimSpace(part), "=")
+		if !IsRegion(region) {
+			return nil, fmt.Errorf("region '%s' is not a 3 letter Fly region code", region)
+		}
+		for _, rc := range out {
+			if rc.Region == region {
+				return nil, fmt.Errorf("region '%s' is listed more than once", region)
+			}
+		}
+		rc := RegionCount{Region: region, Count: 1}
+		if hasCount {
+			var err error
+			if rc.Count, err = strconv.Atoi(rawCount); err != nil || rc.Count < 1 {
+				return nil, fmt.Errorf("region '%s' count '%s' is not a positive integer", region, rawCount)
+			}
+		}
+		out = append(out, rc)
+	}
+	return out, nil
+}
+
+// WorkloadRegions returns the machine count per region from the regions annotation on the workload, or nil if it is
+// not set.
+func WorkloadRegions(currentState *state.State, workloadName string) ([]RegionCount, error) {
+	workloadAnnotations, _ := currentState.Workloads[workloadName].Spec.Metadata["annotations"].(map[string]interface{})
+	if v, _ := workloadAnnotations[annotationPrefix+regionsAnnotation].(string); v != "" {
+		return parseRegions(v)
+	}
+	return nil, nil
+}
+
+// primaryRegion returns the first region of the regions annotation, falling back to the region stored at init time.
+func primaryRegion(currentState *state.State, workloadName string) (string, error) {
+	regions, err := WorkloadRegions(currentState, workloadName)
+	if err != nil {
+		return "", fmt.Errorf("annotation '%s%s': %w", annotationPrefix, regionsAnnotation, err)
+	} else if len(regions) > 0 {
+		return regions[0].Region, nil
+	}
+	return currentState.Extras.PrimaryRegion, nil
+}
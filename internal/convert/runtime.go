@@ -0,0 +1,61 @@
+package convert
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/astromechza/score-flyio/internal/appconfig"
+)
+
+const (
+	killSignalAnnotation     = "kill-signal"
+	killTimeoutAnnotation    = "kill-timeout"
+	swapSizeAnnotation       = "swap-size-mb"
+	restartPolicyAnnotation  = "restart-policy"
+	restartRetriesAnnotation = "restart-retries"
+	maxKillTimeout           = 5 * time.Minute
+)
+
+var (
+	killSignals     = []string{"SIGINT", "SIGTERM", "SIGQUIT", "SIGUSR1", "SIGUSR2", "SIGKILL", "SIGSTOP"}
+	restartPolicies = []string{"always", "never", "on-failure"}
+)
+
+// applyRuntimeAnnotations sets the kill signal, kill timeout, swap size, and restart policy from the annotations.
+func applyRuntimeAnnotations(output *appconfig.AppConfig, workloadAnnotations map[string]interface{}) error {
+	if v, _ := workloadAnnotations[annotationPrefix+killSignalAnnotation].(string); v != "" {
+		output.KillSignal = v
+	}
+	if v, _ := workloadAnnotations[annotationPrefix+killTimeoutAnnotation].(string); v != "" {
+		if d, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("failed to parse kill timeout '%s' as a duration: %w", v, err)
+		} else if d <= 0 || d > maxKillTimeout {
+			return fmt.Errorf("kill timeout '%s' must be positive and at most %s", v, maxKillTimeout)
+		}
+		output.KillTimeout = v
+	}
+	if v, _ := workloadAnnotations[annotationPrefix+swapSizeAnnotation].(string); v != "" {
+		if i, err := strconv.Atoi(v); err != nil {
+			return fmt.Errorf("failed to parse swap size '%s' as int: %w", v, err)
+		} else {
+			output.SwapSizeMb = &i
+		}
+	}
+	policy, _ := workloadAnnotations[annotationPrefix+restartPolicyAnnotation].(string)
+	retries, _ := workloadAnnotations[annotationPrefix+restartRetriesAnnotation].(string)
+	if retries != "" && policy != "on-failure" {
+		return fmt.Errorf("restart retries can only be set with the on-failure restart policy")
+	} else if policy != "" {
+		restart := appconfig.Restart{Policy: policy}
+		if retries != "" {
+			i, err := strconv.Atoi(retries)
+			if err != nil {
+				return fmt.Errorf("failed to parse restart retries '%s' as int: %w", retries, err)
+			}
+			restart.Retries = &i
+		}
+		output.Restart = []appconfig.Restart{restart}
+	}
+	return nil
+}
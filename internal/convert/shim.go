@@ -0,0 +1,85 @@
+package convert
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/astromechza/score-flyio/internal/appconfig"
+)
+
+const (
+	initShimAnnotation = "init-shim"
+	initShimPath       = "/.score-flyio/init.sh"
+	initShimVolumesDir = "/.score-flyio/volumes"
+)
+
+// initShim collects the shell steps that emulate file modes, volume sub-paths, and read-only volumes before the
+// container command is run.
+type initShim struct {
+	steps []string
+}
+
+// chmod sets the mode of a mounted file. The mode must be an octal string such as 0755.
+func (s *initShim) chmod(target string, mode string) error {
+	if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+		return fmt.Errorf("mode '%s' is not an octal file mode", mode)
+	}
+	s.steps = append(s.steps, fmt.Sprintf("chmod %s %s", mode, shellJoin([]string{target})))
+	return nil
+}
+
+// link exposes the sub-path of a volume mounted at the given directory at the target path. An empty directory at the
+// target is replaced, while a non-empty one stops the shim since linking would place the link inside it. Read-only
+// volumes are bind mounted and remounted read-only, and the shim stops if the machine does not allow it since a link
+// would leave the volume writable.
+func (s *initShim) link(mountDir string, subPath string, target string, readOnly bool) {
+	source := shellJoin([]string{path.Join(mountDir, subPath)})
+	quotedTarget := shellJoin([]string{target})
+	s.steps = append(s.steps, fmt.Sprintf("mkdir -p %s %s", source, shellJoin([]string{path.Dir(target)})))
+	if !readOnly {
+		s.steps = append(s.steps, fmt.Sprintf(
+			"if [ -d %[2]s ] && [ ! -L %[2]s ] && ! rmdir %[2]s 2>/dev/null; then\n  echo \"score-flyio: cannot link \"%[2]s\" since it is a non-empty directory\" >&2\n  exit 1\nfi\nln -sfn %[1]s %[2]s",
+			source, quotedTarget,
+		))
+		return
+	}
+	s.steps = append(s.steps, fmt.Sprintf(
+		"mkdir -p %[2]s\nif ! mount --bind %[1]s %[2]s || ! mount -o remount,bind,ro %[2]s; then\n  echo \"score-flyio: could not mount \"%[2]s\" read-only\" >&2\n  exit 1\nfi",
+		source, quotedTarget,
+	))
+}
+
+// script returns the init shim script that runs each step before running the original command passed as arguments.
+func (s *initShim) script() string {
+	sb := new(strings.Builder)
+	sb.WriteString("#!/bin/sh\n# generated by score-flyio to emulate file modes and volume sub-paths\nset -e\n")
+	for _, step := range s.steps {
+		sb.WriteString(step)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("exec \"$@\"\n")
+	return sb.String()
+}
+
+// apply mounts the init shim script and wraps the container command with it, unless there are no steps to run.
+func (s *initShim) apply(output *appconfig.AppConfig) error {
+	if len(s.steps) == 0 {
+		return nil
+	}
+	return wrapEntrypoint(output, "the init shim", initShimPath, s.script())
+}
+
+// wrapEntrypoint mounts the shell script at the guest path and prepends it to the container command. The container
+// command must be known since the image entrypoint cannot be wrapped.
+func wrapEntrypoint(output *appconfig.AppConfig, feature string, guestPath string, script string) error {
+	if output.Experimental == nil || len(output.Experimental.Entrypoint) == 0 {
+		return fmt.Errorf("%s requires the container command to be set", feature)
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(script))
+	output.Files = append(output.Files, appconfig.File{GuestPath: guestPath, RawValue: &encoded})
+	output.Experimental.Entrypoint = append([]string{"/bin/sh", guestPath}, output.Experimental.Entrypoint...)
+	return nil
+}
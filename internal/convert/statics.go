@@ -0,0 +1,54 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	scoretypes "github.com/score-spec/score-go/types"
+
+	"github.com/astromechza/score-flyio/internal/appconfig"
+)
+
+const staticsAnnotation = "statics"
+
+// pathWithin returns true if the child path is equal to or inside the parent directory.
+func pathWithin(child, parent string) bool {
+	child, parent = path.Clean(child), path.Clean(parent)
+	return child == parent || parent == "/" || strings.HasPrefix(child, parent+"/")
+}
+
+// buildStatics parses the statics annotation. Fly serves statics from the image filesystem, so guest paths inside a
+// volume are rejected, and container files inside a guest path are warned about since they are only written at runtime.
+func buildStatics(container scoretypes.Container, workloadAnnotations map[string]interface{}) ([]appconfig.Static, error) {
+	v, _ := workloadAnnotations[annotationPrefix+staticsAnnotation].(string)
+	if v == "" {
+		return nil, nil
+	}
+	var statics []appconfig.Static
+	decoder := json.NewDecoder(strings.NewReader(v))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&statics); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal statics annotation: %w", err)
+	}
+	for i, static := range statics {
+		if !path.IsAbs(static.GuestPath) {
+			return nil, fmt.Errorf("statics[%d]: guest_path '%s' must be an absolute path", i, static.GuestPath)
+		} else if !strings.HasPrefix(static.UrlPrefix, "/") {
+			return nil, fmt.Errorf("statics[%d]: url_prefix '%s' must start with /", i, static.UrlPrefix)
+		}
+		for _, volume := range container.Volumes {
+			if pathWithin(static.GuestPath, volume.Target) {
+				return nil, fmt.Errorf("statics[%d]: guest_path '%s' is inside volume '%s' but statics are served from the image", i, static.GuestPath, volume.Target)
+			}
+		}
+		for _, f := range container.Files {
+			if pathWithin(f.Target, static.GuestPath) {
+				slog.Warn("Container file is inside a statics guest path but files are not part of the image and will not be served", slog.String("file", f.Target), slog.String("guest_path", static.GuestPath))
+			}
+		}
+	}
+	return statics, nil
+}
@@ -0,0 +1,129 @@
+package convert
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	scoretypes "github.com/score-spec/score-go/types"
+
+	"github.com/astromechza/score-flyio/internal/appconfig"
+)
+
+const (
+	vmSizeAnnotation    = "vm-size"
+	vmCpuKindAnnotation = "vm-cpu-kind"
+)
+
+// vmPreset is one of the named Fly machine sizes.
+type vmPreset struct {
+	Size    string
+	CpuKind string
+	Cpus    int
+}
+
+// vmPresets is ordered by cpu kind and then by ascending cpus so that the first matching preset is the smallest.
+var vmPresets = []vmPreset{
+	{Size: "shared-cpu-1x", CpuKind: "shared", Cpus: 1},
+	{Size: "shared-cpu-2x", CpuKind: "shared", Cpus: 2},
+	{Size: "shared-cpu-4x", CpuKind: "shared", Cpus: 4},
+	{Size: "shared-cpu-8x", CpuKind: "shared", Cpus: 8},
+	{Size: "performance-1x", CpuKind: "performance", Cpus: 1},
+	{Size: "performance-2x", CpuKind: "performance", Cpus: 2},
+	{Size: "performance-4x", CpuKind: "performance", Cpus: 4},
+	{Size: "performance-8x", CpuKind: "performance", Cpus: 8},
+	{Size: "performance-16x", CpuKind: "performance", Cpus: 16},
+}
+
+// vmMemoryPerCpuMB is the minimum and maximum memory that Fly allows per cpu of each cpu kind.
+var vmMemoryPerCpuMB = map[string][2]int{
+	"shared":      {256, 2048},
+	"performance": {2048, 8192},
+}
+
+// vmMemoryUnitMB is the granularity of machine memory.
+const vmMemoryUnitMB = 256
+
+var vmCpuKinds = []string{"shared", "performance"}
+
+func vmSizes() []string {
+	out := make([]string, len(vmPresets))
+	for i, p := range vmPresets {
+		out[i] = p.Size
+	}
+	return out
+}
+
+// collateVmResources returns the largest cpu (in millicores) and memory (in MB) of the container requests and limits.
+func collateVmResources(cr scoretypes.ContainerResources) (cpuMillis int, memoryMB int, err error) {
+	for _, rl := range []*scoretypes.ResourcesLimits{cr.Requests, cr.Limits} {
+		if rl != nil {
+			if c, m, err := scoretypes.ParseResourceLimits(*rl); err != nil {
+				return 0, 0, fmt.Errorf("failed to parse resource: %w", err)
+			} else {
+				if c != nil {
+					cpuMillis = max(cpuMillis, *c)
+				}
+				if m != nil {
+					memoryMB = max(memoryMB, int(math.Ceil(float64(*m)/1_000_000)))
+				}
+			}
+		}
+	}
+	return
+}
+
+// buildVm maps the container resources and vm annotations to the nearest valid Fly machine size. The smallest preset of
+// the cpu kind that has enough cpus and allows enough memory is chosen unless the size is set explicitly.
+func buildVm(resources *scoretypes.ContainerResources, workloadAnnotations map[string]interface{}) (*appconfig.Vm, error) {
+	size, _ := workloadAnnotations[annotationPrefix+vmSizeAnnotation].(string)
+	kind, _ := workloadAnnotations[annotationPrefix+vmCpuKindAnnotation].(string)
+	if resources == nil && size == "" && kind == "" {
+		return nil, nil
+	}
+	var cpuMillis, memoryMB int
+	if resources != nil {
+		var err error
+		if cpuMillis, memoryMB, err = collateVmResources(*resources); err != nil {
+			return nil, err
+		}
+	}
+
+	var preset vmPreset
+	if size != "" {
+		i := slices.IndexFunc(vmPresets, func(p vmPreset) bool { return p.Size == size })
+		if i < 0 {
+			return nil, fmt.Errorf("vm size '%s' is not one of %v", size, vmSizes())
+		} else if preset = vmPresets[i]; kind != "" && kind != preset.CpuKind {
+			return nil, fmt.Errorf("vm size '%s' conflicts with cpu kind '%s'", size, kind)
+		} else if cpuMillis > preset.Cpus*1000 {
+			slog.Warn("The vm size has fewer cpus than the container requests", slog.String("size", size), slog.Int("cpu_millis", cpuMillis))
+		}
+		if limit := preset.Cpus * vmMemoryPerCpuMB[preset.CpuKind][1]; memoryMB > limit {
+			return nil, fmt.Errorf("vm size '%s' allows at most %dMB memory but %dMB was requested", size, limit, memoryMB)
+		}
+	} else {
+		if kind == "" {
+			kind = vmCpuKinds[0]
+		}
+		i := slices.IndexFunc(vmPresets, func(p vmPreset) bool {
+			return p.CpuKind == kind && p.Cpus*1000 >= cpuMillis && p.Cpus*vmMemoryPerCpuMB[kind][1] >= memoryMB
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("no %s vm size has enough cpus and memory for %dm cpu and %dMB memory", kind, cpuMillis, memoryMB)
+		}
+		preset = vmPresets[i]
+	}
+
+	memory := max(vmMemoryUnitMB*int(math.Ceil(float64(memoryMB)/vmMemoryUnitMB)), preset.Cpus*vmMemoryPerCpuMB[preset.CpuKind][0])
+	smallest := vmPresets[slices.IndexFunc(vmPresets, func(p vmPreset) bool { return p.CpuKind == preset.CpuKind })]
+	if (cpuMillis > 0 && preset.Cpus*1000 >= 2*cpuMillis && preset.Cpus > smallest.Cpus) ||
+		(memoryMB > 0 && memory >= 2*memoryMB && memory > smallest.Cpus*vmMemoryPerCpuMB[preset.CpuKind][0]) {
+		slog.Warn(
+			"The container resources were rounded up significantly to fit a Fly vm size",
+			slog.String("size", preset.Size), slog.Int("cpu_millis", cpuMillis), slog.Int("memory_mb", memoryMB), slog.Int("vm_memory_mb", memory),
+		)
+	}
+	return &appconfig.Vm{Size: preset.Size, CpuKind: preset.CpuKind, Cpus: preset.Cpus, Memory: fmt.Sprintf("%dMB", memory)}, nil
+}
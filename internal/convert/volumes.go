@@ -0,0 +1,96 @@
+package convert
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/score-spec/score-go/framework"
+
+	"github.com/astromechza/score-flyio/internal/appconfig"
+)
+
+// volumePlaceholder is replaced by the key of a volume in annotation name patterns, see volumeKey.
+const volumePlaceholder = "<volume>"
+
+// volumeSettings are the mount settings that can be set per volume, keyed by the annotation suffix and resource output.
+var volumeSettings = []struct {
+	Annotation string
+	Output     string
+}{
+	{"initial-size", "initial_size"},
+	{"auto-extend-size-threshold", "auto_extend_size_threshold"},
+	{"auto-extend-size-increment", "auto_extend_size_increment"},
+	{"auto-extend-size-limit", "auto_extend_size_limit"},
+	{"snapshot-retention", "snapshot_retention"},
+}
+
+var (
+	volumeSizeReg           = regexp.MustCompile(`^[0-9]+(?i:[mg]b)?$`)
+	volumeResourceSourceReg = regexp.MustCompile(`^\$\{resources\.([^.}]+)\.[^}]+}$`)
+)
+
+// volumeKey returns the key used in volume annotations for the volume target path, the path without the leading slash
+// and with the remaining slashes replaced by dashes. For example, /var/lib/data becomes var-lib-data.
+func volumeKey(target string) string {
+	return strings.ReplaceAll(strings.Trim(target, "/"), "/", "-")
+}
+
+// hasVolumeAnnotations returns true if any of the volume-<volume>-* annotations is set for the volume key.
+func hasVolumeAnnotations(workloadAnnotations map[string]interface{}, key string) bool {
+	for _, setting := range volumeSettings {
+		if _, ok := workloadAnnotations[fmt.Sprintf("%svolume-%s-%s", annotationPrefix, key, setting.Annotation)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyVolumeSettings sets the sizing and snapshot settings of the mount from the volume-<volume>-* annotations, or
+// from the outputs of the volume resource when the volume source is a single resource placeholder. Annotations take
+// precedence over resource outputs.
+func applyVolumeSettings(mount *appconfig.Mount, target string, rawSource string, resOutputs map[string]framework.OutputLookupFunc, workloadAnnotations map[string]interface{}) error {
+	var lookup framework.OutputLookupFunc
+	if m := volumeResourceSourceReg.FindStringSubmatch(rawSource); m != nil {
+		lookup = resOutputs[m[1]]
+	}
+	for _, setting := range volumeSettings {
+		v, _ := workloadAnnotations[fmt.Sprintf("%svolume-%s-%s", annotationPrefix, volumeKey(target), setting.Annotation)].(string)
+		if v == "" && lookup != nil {
+			if out, err := lookup(setting.Output); err == nil && out != nil {
+				v = fmt.Sprint(out)
+			}
+		}
+		if v == "" {
+			continue
+		}
+		switch setting.Output {
+		case "initial_size", "auto_extend_size_increment", "auto_extend_size_limit":
+			if !volumeSizeReg.MatchString(v) {
+				return fmt.Errorf("%s '%s' must be a size in gb or mb", setting.Annotation, v)
+			}
+			switch setting.Output {
+			case "initial_size":
+				mount.InitialSize = v
+			case "auto_extend_size_increment":
+				mount.AutoExtendSizeIncrement = v
+			case "auto_extend_size_limit":
+				mount.AutoExtendSizeLimit = v
+			}
+		case "auto_extend_size_threshold":
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 1 || i > 99 {
+				return fmt.Errorf("%s '%s' must be a percentage between 1 and 99", setting.Annotation, v)
+			}
+			mount.AutoExtendSizeThreshold = &i
+		case "snapshot_retention":
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 1 || i > 60 {
+				return fmt.Errorf("%s '%s' must be a number of days between 1 and 60", setting.Annotation, v)
+			}
+			mount.SnapshotRetention = &i
+		}
+	}
+	return nil
+}
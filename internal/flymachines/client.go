@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/astromechza/score-flyio/internal"
@@ -68,6 +69,27 @@ func ListMachines(c ClientWithResponsesInterface, app string, state *string) ([]
 	return *(resp.JSON200), nil
 }
 
+// MachineRegions returns the sorted regions that have machines in the process group of the app. Machines without a
+// process group belong to the default "app" process group.
+func MachineRegions(c ClientWithResponsesInterface, app string, processGroup string) ([]string, error) {
+	machines, err := ListMachines(c, app, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0)
+	for _, m := range machines {
+		group := "app"
+		if m.Config != nil && m.Config.Metadata != nil && (*m.Config.Metadata)["fly_process_group"] != "" {
+			group = (*m.Config.Metadata)["fly_process_group"]
+		}
+		if group == processGroup && m.Region != nil && !slices.Contains(out, *m.Region) {
+			out = append(out, *m.Region)
+		}
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
 func ExecMachine(c ClientWithResponsesInterface, app, machine string, command []string) error {
 	resp, err := c.MachinesExecWithResponse(context.Background(), app, machine, MachineExecRequest{
 		Command: &command,
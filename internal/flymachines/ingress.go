@@ -0,0 +1,233 @@
+package flymachines
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const graphqlUrl = "https://api.fly.io/graphql"
+
+// Ip address types as accepted by the Fly GraphQL api.
+const (
+	IpTypeSharedV4 = "shared_v4"
+	IpTypeV4       = "v4"
+	IpTypeV6       = "v6"
+	// IpTypePrivateV6 is a Flycast address that is only reachable from the private network of the organization.
+	IpTypePrivateV6 = "private_v6"
+)
+
+type IpAddress struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+}
+
+type Certificate struct {
+	Hostname              string `json:"hostname"`
+	DnsValidationHostname string `json:"dnsValidationHostname"`
+	DnsValidationTarget   string `json:"dnsValidationTarget"`
+}
+
+// Ingress manages the public ip addresses and certificates of a Fly app. This is an interface so that it can be faked
+// in tests. Releasing an ip or deleting a certificate that no longer exists is not an error.
+type Ingress interface {
+	EnsureApp(app string) error
+	ListIps(app string) ([]IpAddress, error)
+	AllocateIp(app string, ipType string) (*IpAddress, error)
+	ReleaseIp(app string, address string) error
+	AddCertificate(app string, hostname string) (*Certificate, error)
+	DeleteCertificate(app string, hostname string) error
+}
+
+type flyIngress struct {
+	client *FlyClient
+}
+
+// NewIngress returns an Ingress that uses flyctl and the Fly GraphQL api with the FLY_API_TOKEN.
+func NewIngress() (Ingress, error) {
+	c, err := NewFlyClient()
+	if err != nil {
+		return nil, err
+	}
+	return &flyIngress{client: c}, nil
+}
+
+func (f *flyIngress) EnsureApp(app string) error {
+	if _, ok, err := GetApp(f.client, app); err != nil {
+		return fmt.Errorf("failed to get app: %w", err)
+	} else if ok {
+		return nil
+	}
+	slog.Info("Creating app", slog.String("app", app))
+	c := exec.Command("fly", "apps", "create", "--access-token", f.client.ApiToken, app)
+	c.Stderr = os.Stderr
+	c.Stdout = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("failed to create app: %w", err)
+	}
+	return nil
+}
+
+func (f *flyIngress) ListIps(app string) ([]IpAddress, error) {
+	var out struct {
+		App struct {
+			SharedIpAddress string `json:"sharedIpAddress"`
+			IpAddresses     struct {
+				Nodes []IpAddress `json:"nodes"`
+			} `json:"ipAddresses"`
+		} `json:"app"`
+	}
+	if err := f.graphql(`query($appName: String!) {
+  app(name: $appName) { sharedIpAddress ipAddresses { nodes { address type } } }
+}`, map[string]interface{}{"appName": app}, &out); err != nil {
+		return nil, fmt.Errorf("failed to list ips: %w", err)
+	}
+	ips := out.App.IpAddresses.Nodes
+	if out.App.SharedIpAddress != "" {
+		ips = append(ips, IpAddress{Address: out.App.SharedIpAddress, Type: IpTypeSharedV4})
+	}
+	return ips, nil
+}
+
+func (f *flyIngress) AllocateIp(app string, ipType string) (*IpAddress, error) {
+	var out struct {
+		AllocateIpAddress struct {
+			IpAddress *IpAddress `json:"ipAddress"`
+			App       struct {
+				SharedIpAddress string `json:"sharedIpAddress"`
+			} `json:"app"`
+		} `json:"allocateIpAddress"`
+	}
+	if err := f.graphql(`mutation($input: AllocateIPAddressInput!) {
+  allocateIpAddress(input: $input) { ipAddress { address type } app { sharedIpAddress } }
+}`, map[string]interface{}{"input": map[string]interface{}{"appId": app, "type": ipType}}, &out); err != nil {
+		return nil, fmt.Errorf("failed to allocate %s ip: %w", ipType, err)
+	}
+	if ipType == IpTypeSharedV4 {
+		return &IpAddress{Address: out.AllocateIpAddress.App.SharedIpAddress, Type: ipType}, nil
+	} else if out.AllocateIpAddress.IpAddress == nil {
+		return nil, fmt.Errorf("failed to allocate %s ip: no address returned", ipType)
+	}
+	return out.AllocateIpAddress.IpAddress, nil
+}
+
+func (f *flyIngress) ReleaseIp(app string, address string) error {
+	if err := f.graphql(`mutation($input: ReleaseIPAddressInput!) {
+  releaseIpAddress(input: $input) { app { name } }
+}`, map[string]interface{}{"input": map[string]interface{}{"appId": app, "ip": address}}, nil); isNotFound(err) {
+		slog.Debug("Ip was already released", slog.String("app", app), slog.String("ip", address))
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to release ip %s: %w", address, err)
+	}
+	return nil
+}
+
+func (f *flyIngress) AddCertificate(app string, hostname string) (*Certificate, error) {
+	var out struct {
+		AddCertificate struct {
+			Certificate Certificate `json:"certificate"`
+		} `json:"addCertificate"`
+	}
+	if err := f.graphql(`mutation($appId: ID!, $hostname: String!) {
+  addCertificate(appId: $appId, hostname: $hostname) { certificate { hostname dnsValidationHostname dnsValidationTarget } }
+}`, map[string]interface{}{"appId": app, "hostname": hostname}, &out); err != nil {
+		return nil, fmt.Errorf("failed to add certificate for %s: %w", hostname, err)
+	}
+	return &out.AddCertificate.Certificate, nil
+}
+
+func (f *flyIngress) DeleteCertificate(app string, hostname string) error {
+	if err := f.graphql(`mutation($appId: ID!, $hostname: String!) {
+  deleteCertificate(appId: $appId, hostname: $hostname) { app { name } }
+}`, map[string]interface{}{"appId": app, "hostname": hostname}, nil); isNotFound(err) {
+		slog.Debug("Certificate was already deleted", slog.String("app", app), slog.String("hostname", hostname))
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to delete certificate for %s: %w", hostname, err)
+	}
+	return nil
+}
+
+// graphql sends the query and decodes the data of the response into out if it is not nil.
+func (f *flyIngress) graphql(query string, variables map[string]interface{}, out interface{}) error {
+	raw, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, graphqlUrl, bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+f.client.ApiToken)
+	req.Header.Set("Content-Type", "application/json")
+	slog.Debug("Making GraphQL request", slog.String("url", graphqlUrl))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("graphql request failed: %s: %s", res.Status, string(body))
+	}
+	var decoded struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return fmt.Errorf("failed to decode graphql response: %w", err)
+	} else if len(decoded.Errors) > 0 {
+		errs := make([]error, len(decoded.Errors))
+		for i, e := range decoded.Errors {
+			errs[i] = errors.New(e.Message)
+		}
+		return errors.Join(errs...)
+	} else if out != nil {
+		if err := json.Unmarshal(decoded.Data, out); err != nil {
+			return fmt.Errorf("failed to decode graphql data: %w", err)
+		}
+	}
+	return nil
+}
+
+// isNotFound returns true if the graphql error reports that the ip or certificate does not exist.
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "could not find")
+}
+
+// EnsurePrivateIp allocates a Flycast private ipv6 address for the app if it does not already have one, and returns any
+// public ips that the app has.
+func EnsurePrivateIp(i Ingress, app string) ([]IpAddress, error) {
+	ips, err := i.ListIps(app)
+	if err != nil {
+		return nil, err
+	}
+	public := make([]IpAddress, 0)
+	hasPrivate := false
+	for _, ip := range ips {
+		if ip.Type == IpTypePrivateV6 {
+			hasPrivate = true
+		} else {
+			public = append(public, ip)
+		}
+	}
+	if !hasPrivate {
+		slog.Info("Allocating private Flycast ip", slog.String("app", app))
+		if _, err := i.AllocateIp(app, IpTypePrivateV6); err != nil {
+			return nil, err
+		}
+	}
+	return public, nil
+}
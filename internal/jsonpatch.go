@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JsonPatchOperation is a single operation of a JSON Patch as defined in https://datatracker.ietf.org/doc/html/rfc6902.
+type JsonPatchOperation struct {
+	Op    string      `json:"op" yaml:"op"`
+	Path  string      `json:"path" yaml:"path"`
+	From  string      `json:"from,omitempty" yaml:"from,omitempty"`
+	Value interface{} `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// ApplyJsonPatch applies the JSON Patch operations in order and returns the new document.
+//
+// Like PatchMap, this should return a new document without modifying the input. Maps and slices are copied along the
+// path of each operation.
+func ApplyJsonPatch(doc interface{}, operations []JsonPatchOperation) (interface{}, error) {
+	for i, operation := range operations {
+		path, err := parseJsonPointer(operation.Path)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: path: %w", i, err)
+		}
+		switch operation.Op {
+		case "add":
+			doc, err = jsonPatchSet(doc, path, operation.Value, false)
+		case "replace":
+			doc, err = jsonPatchSet(doc, path, operation.Value, true)
+		case "remove":
+			doc, _, err = jsonPatchRemove(doc, path)
+		case "move", "copy":
+			var from []string
+			if from, err = parseJsonPointer(operation.From); err != nil {
+				return nil, fmt.Errorf("operation %d: from: %w", i, err)
+			}
+			var value interface{}
+			if operation.Op == "move" {
+				doc, value, err = jsonPatchRemove(doc, from)
+			} else {
+				value, err = jsonPatchGet(doc, from)
+			}
+			if err == nil {
+				doc, err = jsonPatchSet(doc, path, value, false)
+			}
+		case "test":
+			var value interface{}
+			if value, err = jsonPatchGet(doc, path); err == nil && !reflect.DeepEqual(value, operation.Value) {
+				err = fmt.Errorf("value at '%s' does not match", operation.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op '%s'", operation.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	} else if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("json pointer '%s' must start with /", pointer)
+	}
+	parts := strings.Split(pointer[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+	}
+	return parts, nil
+}
+
+func jsonPatchIndex(key string, length int, allowEnd bool) (int, error) {
+	if key == "-" && allowEnd {
+		return length, nil
+	}
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || i > length || (i == length && !allowEnd) {
+		return 0, fmt.Errorf("invalid array index '%s'", key)
+	}
+	return i, nil
+}
+
+func jsonPatchGet(doc interface{}, path []string) (interface{}, error) {
+	for _, key := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[key]
+			if !ok {
+				return nil, fmt.Errorf("key '%s' not found", key)
+			}
+			doc = v
+		case []interface{}:
+			i, err := jsonPatchIndex(key, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("cannot lookup key '%s', context is not a map or array", key)
+		}
+	}
+	return doc, nil
+}
+
+func jsonPatchSet(doc interface{}, path []string, value interface{}, replace bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	key := path[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		existing, ok := d[key]
+		if !ok && (replace || len(path) > 1) {
+			return nil, fmt.Errorf("key '%s' not found", key)
+		}
+		if len(path) > 1 {
+			var err error
+			if value, err = jsonPatchSet(existing, path[1:], value, replace); err != nil {
+				return nil, err
+			}
+		}
+		out := maps.Clone(d)
+		out[key] = value
+		return out, nil
+	case []interface{}:
+		i, err := jsonPatchIndex(key, len(d), len(path) == 1 && !replace)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 && !replace {
+			return slices.Insert(slices.Clone(d), i, value), nil
+		} else if len(path) > 1 {
+			if value, err = jsonPatchSet(d[i], path[1:], value, replace); err != nil {
+				return nil, err
+			}
+		}
+		out := slices.Clone(d)
+		out[i] = value
+		return out, nil
+	default:
+		return nil, fmt.Errorf("cannot set key '%s', context is not a map or array", key)
+	}
+}
+
+func jsonPatchRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the root document")
+	}
+	key := path[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		existing, ok := d[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("key '%s' not found", key)
+		}
+		out := maps.Clone(d)
+		if len(path) == 1 {
+			delete(out, key)
+			return out, existing, nil
+		}
+		child, removed, err := jsonPatchRemove(existing, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		out[key] = child
+		return out, removed, nil
+	case []interface{}:
+		i, err := jsonPatchIndex(key, len(d), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			return slices.Delete(slices.Clone(d), i, i+1), d[i], nil
+		}
+		child, removed, err := jsonPatchRemove(d[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		out := slices.Clone(d)
+		out[i] = child
+		return out, removed, nil
+	default:
+		return nil, nil, fmt.Errorf("cannot remove key '%s', context is not a map or array", key)
+	}
+}
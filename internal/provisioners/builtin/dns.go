@@ -0,0 +1,187 @@
+package builtin
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+
+	"github.com/score-spec/score-go/framework"
+
+	"github.com/astromechza/score-flyio/internal/convert"
+	"github.com/astromechza/score-flyio/internal/flymachines"
+	"github.com/astromechza/score-flyio/internal/provisioners"
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+// DnsResourceType is the resource type used to expose a workload on a public hostname.
+const DnsResourceType = "dns"
+
+var dnsIpModes = []string{"shared", "dedicated"}
+
+// NewDnsProvisioner returns a builtin provisioner for the dns resource type. It allocates a shared or dedicated ip for
+// the app of the workload and adds a certificate for the host param, falling back to the <app>.fly.dev hostname. The
+// dns records that must be created for the host are returned as outputs and logged.
+func NewDnsProvisioner(newIngress func() (flymachines.Ingress, error)) provisioners.BuiltinProvisioner {
+	return provisioners.BuiltinProvisioner{
+		Provision: func(currentState *state.State, resUid framework.ResourceUid, resState framework.ScoreResourceState[state.ResourceExtras]) (*provisioners.ProvisionerOutputs, error) {
+			app := convert.AppName(currentState, resState.SourceWorkload)
+			host, _ := resState.Params["host"].(string)
+			ipMode, _ := resState.Params["ip"].(string)
+			if ipMode == "" {
+				ipMode = dnsIpModes[0]
+			} else if !slices.Contains(dnsIpModes, ipMode) {
+				return nil, fmt.Errorf("ip param '%s' is not one of %v", ipMode, dnsIpModes)
+			}
+			desired := map[string]interface{}{"app": app, "host": host, "ip": ipMode}
+			if len(resState.Outputs) > 0 && reflect.DeepEqual(desired, map[string]interface{}{
+				"app": resState.State["app"], "host": resState.State["host"], "ip": resState.State["ip"],
+			}) {
+				return &provisioners.ProvisionerOutputs{ResourceState: resState.State, ResourceValues: resState.Outputs}, nil
+			}
+
+			ingress, err := newIngress()
+			if err != nil {
+				return nil, fmt.Errorf("failed to setup fly api client: %w", err)
+			}
+			if len(resState.State) > 0 {
+				slog.Info("Dns resource has changed, releasing the previous ips and certificate", slog.String("uid", string(resUid)))
+				if err := releaseDns(ingress, currentState, resUid, resState.State); err != nil {
+					return nil, err
+				}
+			}
+			if err := ingress.EnsureApp(app); err != nil {
+				return nil, err
+			}
+
+			ipTypes := []string{flymachines.IpTypeSharedV4}
+			if ipMode == "dedicated" {
+				ipTypes = []string{flymachines.IpTypeV4, flymachines.IpTypeV6}
+			}
+			ips := make([]interface{}, 0, len(ipTypes))
+			values := map[string]interface{}{}
+			records := make([]interface{}, 0)
+			// the resource state is only saved on success, so anything allocated so far is released on failure to
+			// avoid leaking it when the provision is retried
+			rollback := func(err error) error {
+				if rbErr := releaseDns(ingress, currentState, resUid, map[string]interface{}{"app": app, "ips": ips}); rbErr != nil {
+					slog.Warn("Failed to release the ips allocated for the dns resource", slog.String("uid", string(resUid)), slog.String("err", rbErr.Error()))
+				}
+				return err
+			}
+			existing := make([]flymachines.IpAddress, 0)
+			if ipMode == "shared" {
+				if existing, err = ingress.ListIps(app); err != nil {
+					return nil, err
+				}
+			}
+			for _, ipType := range ipTypes {
+				var ip *flymachines.IpAddress
+				// a shared ip that existed before is only released if another dns resource allocated it, since it may
+				// have been allocated by fly deploy or by hand
+				allocated := false
+				if i := slices.IndexFunc(existing, func(ip flymachines.IpAddress) bool { return ip.Type == ipType }); i >= 0 {
+					ip = &existing[i]
+					allocated = sharedIpAllocated(currentState, resUid, app, ip.Address)
+					slog.Info("Using the existing shared ip of the app", slog.String("app", app), slog.String("ip", ip.Address))
+				} else if ip, err = ingress.AllocateIp(app, ipType); err != nil {
+					return nil, rollback(err)
+				} else {
+					allocated = true
+				}
+				ips = append(ips, map[string]interface{}{"address": ip.Address, "type": ip.Type, "allocated": allocated})
+				recordType, key := "A", "ipv4"
+				if ipType == flymachines.IpTypeV6 {
+					recordType, key = "AAAA", "ipv6"
+				}
+				values[key] = ip.Address
+				if host != "" {
+					records = append(records, map[string]interface{}{"type": recordType, "name": host, "value": ip.Address})
+				}
+			}
+			desired["ips"] = ips
+
+			if host != "" {
+				cert, err := ingress.AddCertificate(app, host)
+				if err != nil {
+					return nil, rollback(err)
+				}
+				desired["certificate"] = true
+				if cert.DnsValidationHostname != "" && cert.DnsValidationTarget != "" {
+					records = append(records, map[string]interface{}{"type": "CNAME", "name": cert.DnsValidationHostname, "value": cert.DnsValidationTarget})
+				}
+			} else {
+				host = app + ".fly.dev"
+			}
+			values["host"] = host
+			values["records"] = records
+			for _, r := range records {
+				rm := r.(map[string]interface{})
+				slog.Info("Create this dns record for the host", slog.String("type", rm["type"].(string)), slog.String("name", rm["name"].(string)), slog.String("value", rm["value"].(string)))
+			}
+			return &provisioners.ProvisionerOutputs{ResourceState: desired, ResourceValues: values}, nil
+		},
+		DeProvision: func(currentState *state.State, resUid framework.ResourceUid, resState framework.ScoreResourceState[state.ResourceExtras]) error {
+			if len(resState.State) == 0 {
+				return nil
+			}
+			ingress, err := newIngress()
+			if err != nil {
+				return fmt.Errorf("failed to setup fly api client: %w", err)
+			}
+			return releaseDns(ingress, currentState, resUid, resState.State)
+		},
+	}
+}
+
+// releaseDns deletes the certificate and releases the ips recorded in the resource state that were allocated by a dns
+// resource. The shared ip of the app is kept if another dns resource for the same app still exists.
+func releaseDns(ingress flymachines.Ingress, currentState *state.State, resUid framework.ResourceUid, resourceState map[string]interface{}) error {
+	app, _ := resourceState["app"].(string)
+	if host, _ := resourceState["host"].(string); host != "" && resourceState["certificate"] == true {
+		if err := ingress.DeleteCertificate(app, host); err != nil {
+			return err
+		}
+	}
+	ips, _ := resourceState["ips"].([]interface{})
+	for _, raw := range ips {
+		ip, _ := raw.(map[string]interface{})
+		address, _ := ip["address"].(string)
+		if ip["allocated"] != true {
+			slog.Info("Keeping the ip since it was not allocated by the dns resource", slog.String("app", app), slog.String("ip", address))
+			continue
+		} else if ip["type"] == flymachines.IpTypeSharedV4 && sharedIpInUse(currentState, resUid, app) {
+			slog.Info("Keeping the shared ip since it is used by another dns resource", slog.String("app", app), slog.String("ip", address))
+			continue
+		}
+		if err := ingress.ReleaseIp(app, address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sharedIpInUse(currentState *state.State, resUid framework.ResourceUid, app string) bool {
+	for uid, other := range currentState.Resources {
+		if uid != resUid && other.Type == DnsResourceType && other.State["app"] == app {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedIpAllocated returns true if another dns resource for the app allocated the shared ip.
+func sharedIpAllocated(currentState *state.State, resUid framework.ResourceUid, app string, address string) bool {
+	for uid, other := range currentState.Resources {
+		if uid == resUid || other.Type != DnsResourceType || other.State["app"] != app {
+			continue
+		}
+		ips, _ := other.State["ips"].([]interface{})
+		for _, raw := range ips {
+			if ip, _ := raw.(map[string]interface{}); ip["address"] == address && ip["allocated"] == true {
+				return true
+			}
+		}
+	}
+	return false
+}
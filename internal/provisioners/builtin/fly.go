@@ -7,11 +7,15 @@ import (
 	"github.com/astromechza/score-flyio/internal/state"
 )
 
-func flyRegion() (string, error) {
-	if v, ok := os.LookupEnv("FLY_REGION_NAME"); ok && v != "" {
+// flyRegion returns the primary region stored in the shared state at score-flyio init time, falling back to the
+// FLY_REGION_NAME environment variable.
+func flyRegion(sharedState map[string]interface{}) (string, error) {
+	if v, _ := sharedState[state.SharedStateRegionKey].(string); v != "" {
+		return v, nil
+	} else if v, ok := os.LookupEnv("FLY_REGION_NAME"); ok && v != "" {
 		return v, nil
 	}
-	return "", fmt.Errorf("FLY_REGION_NAME not set")
+	return "", fmt.Errorf("no region set, use 'score-flyio init --fly-region' or set FLY_REGION_NAME")
 }
 
 // FlyAppPrefixFromState extracts the app prefix from the shared state which should have been inserted at score-flyio init time.
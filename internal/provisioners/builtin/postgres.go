@@ -44,7 +44,7 @@ var (
 				"password": password,
 			},
 		}
-		createErr := ensurePostgresInstance(fc, pgApp, password, stderr)
+		createErr := ensurePostgresInstance(fc, pgApp, password, inputs.SharedState, stderr)
 		if createErr == nil {
 			outputs.ResourceValues = map[string]interface{}{
 				"host":     pgApp + ".flycast",
@@ -98,7 +98,7 @@ var (
 				},
 			},
 		}
-		if err := ensurePostgresInstance(fc, pgApp, password, stderr); err != nil {
+		if err := ensurePostgresInstance(fc, pgApp, password, inputs.SharedState, stderr); err != nil {
 			return outputs, fmt.Errorf("failed to ensure postgres instance: %w", err)
 		}
 		dbName, ok := inputs.ResourceState["database"].(string)
@@ -199,13 +199,13 @@ var (
 	})
 )
 
-func ensurePostgresInstance(c *flymachines.FlyClient, app, password string, stderr io.Writer) error {
+func ensurePostgresInstance(c *flymachines.FlyClient, app, password string, sharedState map[string]interface{}, stderr io.Writer) error {
 	if flyApp, ok, err := flymachines.GetApp(c, app); err != nil {
 		return err
 	} else if ok {
 		slog.Info("Postgres app already exists", slog.String("app", app), slog.String("status", *flyApp.Status))
 	} else {
-		region, err := flyRegion()
+		region, err := flyRegion(sharedState)
 		if err != nil {
 			return err
 		}
@@ -223,9 +223,13 @@ func ensurePostgresInstance(c *flymachines.FlyClient, app, password string, stde
 	return nil
 }
 
+// Install adds the builtin cmd provisioners to the parent command and registers the in-process builtin provisioners
+// that need access to the whole project state.
 func Install(parent *cobra.Command) {
 	group := &cobra.Command{Use: "builtin-provisioners"}
 	group.AddCommand(buildProvisionGroup("postgres-instance", builtinPostgresInstanceProvision, builtinPostgresInstanceDeProvision))
 	group.AddCommand(buildProvisionGroup("postgres", builtinPostgresProvision, builtinPostgresDeProvision))
 	parent.AddCommand(group)
+	provisioners.RegisterBuiltinProvisioner(ServiceResourceType, provisioners.BuiltinProvisioner{Provision: provisionService})
+	provisioners.RegisterBuiltinProvisioner(DnsResourceType, NewDnsProvisioner(flymachines.NewIngress))
 }
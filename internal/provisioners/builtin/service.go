@@ -0,0 +1,91 @@
+package builtin
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/score-spec/score-go/framework"
+
+	"github.com/astromechza/score-flyio/internal"
+	"github.com/astromechza/score-flyio/internal/convert"
+	"github.com/astromechza/score-flyio/internal/provisioners"
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+// ServiceResourceType is the resource type used to discover the address of another workload in the project.
+const ServiceResourceType = "service"
+
+// provisionService is a builtin provisioner for the service resource type. The target workload is the workload param or
+// the resource name. The .flycast address only resolves for apps with a private ip, so private-only targets are reached
+// through the Fly Proxy on the port that the generated service listens on, while other targets are reached directly
+// on the .internal address with the target port. A target workload that has not been generated yet only has the
+// .internal host.
+func provisionService(currentState *state.State, resUid framework.ResourceUid, resState framework.ScoreResourceState[state.ResourceExtras]) (*provisioners.ProvisionerOutputs, error) {
+	target, _ := resState.Params["workload"].(string)
+	if target == "" {
+		_, target, _ = strings.Cut(resState.Id, ".")
+	}
+	if target == resState.SourceWorkload {
+		return nil, fmt.Errorf("workload '%s' cannot depend on itself", target)
+	}
+	workload, ok := currentState.Workloads[target]
+	if !ok {
+		// every resource is provisioned on each generate, so this resolves once the target workload has been generated
+		slog.Warn("Service resource refers to a workload that is not part of the project yet, only the .internal host is available until it is generated", slog.String("uid", string(resUid)), slog.String("workload", target))
+	}
+	app := convert.AppName(currentState, target)
+	values := map[string]interface{}{"app": app, "host": app + ".internal"}
+	if ok && workload.Spec.Service != nil && len(workload.Spec.Service.Ports) > 0 {
+		members := []string{target}
+		if group := convert.AppGroup(currentState, target); group != "" {
+			members = convert.GroupWorkloads(currentState, group)
+		}
+		private, err := convert.AppPrivate(currentState, members)
+		if err != nil {
+			return nil, fmt.Errorf("workload '%s': %w", target, err)
+		}
+		workloadAnnotations, _ := workload.Spec.Metadata["annotations"].(map[string]interface{})
+		host := app + ".internal"
+		if private {
+			host = app + ".flycast"
+		}
+		ports := make(map[string]interface{}, len(workload.Spec.Service.Ports))
+		for _, name := range slices.Sorted(maps.Keys(workload.Spec.Service.Ports)) {
+			port := workload.Spec.Service.Ports[name]
+			portNumber := port.Port
+			if !private {
+				portNumber = internal.DerefOr(port.TargetPort, port.Port)
+			} else if convert.ServiceHttp(workloadAnnotations, name) {
+				// an http_service always listens on 80 regardless of the declared service port
+				portNumber = 80
+			}
+			ports[name] = map[string]interface{}{"host": host, "port": portNumber}
+			if len(workload.Spec.Service.Ports) == 1 {
+				values["port"] = portNumber
+			}
+		}
+		values["host"], values["ports"] = host, ports
+	}
+	return &provisioners.ProvisionerOutputs{
+		ResourceState:  map[string]interface{}{"workload": target},
+		ResourceValues: values,
+	}, nil
+}
+
+// WorkloadDependencies returns the sorted names of the workloads that the workload refers to through service resources
+// and which should therefore be deployed first.
+func WorkloadDependencies(currentState *state.State, workloadName string) []string {
+	out := make([]string, 0)
+	for _, res := range currentState.Resources {
+		if res.Type != ServiceResourceType || res.SourceWorkload != workloadName {
+			continue
+		} else if target, _ := res.State["workload"].(string); target != "" && !slices.Contains(out, target) {
+			out = append(out, target)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
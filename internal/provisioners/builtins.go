@@ -0,0 +1,29 @@
+package provisioners
+
+import (
+	"github.com/score-spec/score-go/framework"
+
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+// BuiltinProvisionerPrefix is the prefix of the provisioner uri recorded for resources provisioned by a builtin
+// provisioner.
+const BuiltinProvisionerPrefix = "builtin://"
+
+// BuiltinProvisioner provisions a resource in-process with access to the whole project state, this allows it to
+// inspect other workloads in the project.
+type BuiltinProvisioner struct {
+	Provision func(currentState *state.State, resUid framework.ResourceUid, resState framework.ScoreResourceState[state.ResourceExtras]) (*ProvisionerOutputs, error)
+	// DeProvision is optional and releases anything created for the resource before the resource state is removed.
+	DeProvision func(currentState *state.State, resUid framework.ResourceUid, resState framework.ScoreResourceState[state.ResourceExtras]) error
+}
+
+var builtinProvisioners = make(map[string]BuiltinProvisioner)
+
+// RegisterBuiltinProvisioner registers a builtin provisioner for a resource type and returns the provisioner that it
+// replaced. Builtin provisioners are only used when none of the configured provisioners match the resource.
+func RegisterBuiltinProvisioner(resourceType string, provisioner BuiltinProvisioner) BuiltinProvisioner {
+	previous := builtinProvisioners[resourceType]
+	builtinProvisioners[resourceType] = provisioner
+	return previous
+}
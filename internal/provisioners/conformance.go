@@ -0,0 +1,116 @@
+package provisioners
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/score-spec/score-go/framework"
+	scoretypes "github.com/score-spec/score-go/types"
+
+	"github.com/astromechza/score-flyio/internal"
+	"github.com/astromechza/score-flyio/internal/state"
+)
+
+const conformanceWorkloadName = "conformance"
+
+// ConformanceStep is the result of a single step of a provisioner conformance test.
+type ConformanceStep struct {
+	Name     string
+	Problems []string
+}
+
+// CheckConformance runs a provision, a second idempotent provision, and a deprovision of a single resource against a
+// scratch state using only the given provisioner. Each step reports any problems found in the provisioner responses.
+// The deprovision always runs, even if provisioning failed, so that anything created remotely is cleaned up.
+func CheckConformance(provisioner state.Provisioner, appPrefix string, resource scoretypes.Resource) ([]ConformanceStep, error) {
+	workload := scoretypes.Workload{
+		ApiVersion: "score.dev/v1b1",
+		Metadata:   scoretypes.WorkloadMetadata{"name": conformanceWorkloadName},
+		Containers: scoretypes.WorkloadContainers{"main": scoretypes.Container{Image: "conformance"}},
+		Resources:  scoretypes.WorkloadResources{"res": resource},
+	}
+	scratch := &state.State{
+		Extras:      state.StateExtras{AppPrefix: appPrefix, Provisioners: []state.Provisioner{provisioner}},
+		SharedState: map[string]interface{}{state.SharedStateAppPrefixKey: appPrefix},
+	}
+	initialShared := maps.Clone(scratch.SharedState)
+	scratch, err := scratch.WithWorkload(&workload, nil, state.WorkloadExtras{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add scratch workload: %w", err)
+	} else if scratch, err = scratch.WithPrimedResources(); err != nil {
+		return nil, fmt.Errorf("failed to prime scratch resource: %w", err)
+	}
+	uid := framework.NewResourceUid(conformanceWorkloadName, "res", resource.Type, resource.Class, resource.Id)
+	if !provisioner.Matches(uid, resource.Metadata) {
+		return nil, fmt.Errorf("provisioner '%s' does not match resource '%s'", provisioner.ProvisionerId, uid)
+	}
+	primed := scratch.Resources[uid]
+
+	steps := make([]ConformanceStep, 0, 3)
+
+	first := ConformanceStep{Name: "provision"}
+	out, err := ProvisionResources(scratch, nil)
+	if out != nil {
+		scratch = out
+	}
+	if err != nil {
+		first.Problems = append(first.Problems, err.Error())
+		return append(steps, first, checkDeprovisionConformance(scratch, provisioner, uid, primed, initialShared)), nil
+	}
+	firstRes := scratch.Resources[uid]
+	firstShared := maps.Clone(scratch.SharedState)
+	steps = append(steps, first)
+
+	second := ConformanceStep{Name: "provision again"}
+	out, err = ProvisionResources(scratch, nil)
+	if out != nil {
+		scratch = out
+	}
+	if err != nil {
+		second.Problems = append(second.Problems, err.Error())
+	} else {
+		secondRes := scratch.Resources[uid]
+		if !reflect.DeepEqual(internal.Or(firstRes.State, map[string]interface{}{}), internal.Or(secondRes.State, map[string]interface{}{})) {
+			second.Problems = append(second.Problems, fmt.Sprintf("resource state is not stable across calls: %v != %v", firstRes.State, secondRes.State))
+		}
+		if !reflect.DeepEqual(internal.Or(firstRes.Outputs, map[string]interface{}{}), internal.Or(secondRes.Outputs, map[string]interface{}{})) {
+			second.Problems = append(second.Problems, fmt.Sprintf("resource values are not stable across calls: %v != %v", firstRes.Outputs, secondRes.Outputs))
+		}
+		if !reflect.DeepEqual(firstShared, scratch.SharedState) {
+			second.Problems = append(second.Problems, fmt.Sprintf("shared state is not stable across calls: %v != %v", firstShared, scratch.SharedState))
+		}
+	}
+	steps = append(steps, second)
+	return append(steps, checkDeprovisionConformance(scratch, provisioner, uid, primed, initialShared)), nil
+}
+
+// checkDeprovisionConformance deprovisions the resource and checks that it was removed and that the shared state keys
+// that existed before provisioning were restored. Keys added by the provisioner may legitimately remain.
+func checkDeprovisionConformance(scratch *state.State, provisioner state.Provisioner, uid framework.ResourceUid, primed framework.ScoreResourceState[state.ResourceExtras], initialShared map[string]interface{}) ConformanceStep {
+	step := ConformanceStep{Name: "deprovision"}
+	rs, ok := scratch.Resources[uid]
+	if !ok {
+		// a failed fallback provision drops the resource from the state, so restore the primed resource
+		rs = primed
+	}
+	if rs.ProvisionerUri == "" {
+		// a failed provision may still have created something, so the provisioner is always asked to clean up
+		rs.ProvisionerUri = provisioner.ProvisionerId
+	}
+	scratch.Resources[uid] = rs
+	out, err := DeProvisionResource(scratch, uid, nil)
+	if err != nil {
+		step.Problems = append(step.Problems, err.Error())
+		return step
+	} else if _, ok := out.Resources[uid]; ok {
+		step.Problems = append(step.Problems, "resource was not removed from the state")
+	}
+	for _, k := range slices.Sorted(maps.Keys(initialShared)) {
+		if v := out.SharedState[k]; !reflect.DeepEqual(initialShared[k], v) {
+			step.Problems = append(step.Problems, fmt.Sprintf("shared state key '%s' was not restored after deprovision: %v != %v", k, initialShared[k], v))
+		}
+	}
+	return step
+}
@@ -18,15 +18,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/score-spec/score-go/framework"
 
@@ -34,7 +38,11 @@ import (
 	"github.com/astromechza/score-flyio/internal/state"
 )
 
-func ProvisionResources(currentState *state.State) (*state.State, error) {
+// Checkpoint is called with the current state whenever provisioning reaches a point that must survive an interruption,
+// such as when an asynchronous operation has been accepted by an http provisioner.
+type Checkpoint func(*state.State) error
+
+func ProvisionResources(currentState *state.State, checkpoint Checkpoint) (*state.State, error) {
 	out := currentState
 
 	orphanedResources := make(map[framework.ResourceUid]bool, len(currentState.Resources))
@@ -69,8 +77,9 @@ ResourceLoop:
 		}
 		resState.Params = params
 
+		var fallbackErrs []error
 		for _, provisioner := range currentState.Extras.Provisioners {
-			if !provisioner.Matches(resUid) {
+			if !provisioner.Matches(resUid, resState.Metadata) {
 				continue
 			}
 
@@ -86,8 +95,18 @@ ResourceLoop:
 			}
 
 			var rawOutputs []byte
+			var err error
 			if provisioner.Http != nil {
-				rawOutputs, err = doHttpRequest(provisioner.Http, http.MethodPost, inputs)
+				var pendingUrl string
+				if po := resState.Extras.PendingOperation; po != nil && po.ProvisionerId == provisioner.ProvisionerId && po.Method == http.MethodPost {
+					slog.Info("Resuming pending provision operation", slog.String("uid", string(resUid)), slog.String("url", po.Url))
+					pendingUrl = po.Url
+				}
+				rawOutputs, err = doHttpRequest(provisioner.Http, http.MethodPost, inputs, pendingUrl, func(operationUrl string) error {
+					resState.Extras.PendingOperation = &state.PendingOperation{ProvisionerId: provisioner.ProvisionerId, Method: http.MethodPost, Url: operationUrl}
+					out.Resources[resUid] = resState
+					return runCheckpoint(checkpoint, out)
+				})
 			} else if provisioner.Cmd != nil {
 				rawOutputs, err = doCmdRequest(provisioner.Cmd, "provision", inputs)
 			} else if provisioner.Static != nil {
@@ -97,20 +116,49 @@ ResourceLoop:
 			} else {
 				return out, fmt.Errorf("%s: provisioner is missing cmd or http section", resUid)
 			}
+			var outputs ProvisionerOutputs
+			var attemptErr error
 			if len(rawOutputs) == 0 {
 				if err != nil {
-					return out, fmt.Errorf("%s: failed to call provisioner: %w", resUid, err)
+					attemptErr = fmt.Errorf("%s: failed to call provisioner: %w", resUid, err)
+				} else {
+					attemptErr = fmt.Errorf("provision request returned no output")
+				}
+			} else {
+				dec := json.NewDecoder(bytes.NewReader(rawOutputs))
+				dec.DisallowUnknownFields()
+				if decErr := dec.Decode(&outputs); decErr != nil {
+					slog.Debug("invalid provisioner outputs", slog.String("raw", string(rawOutputs)))
+					attemptErr = fmt.Errorf("%s: failed to decode response from provisioner: %w", resUid, decErr)
+				} else if err != nil && provisioner.Fallback {
+					attemptErr = fmt.Errorf("%s: failed to provision: %w", resUid, err)
+				} else if err == nil {
+					attemptErr = checkExpectedOutputs(resUid, provisioner, internal.Or(outputs.ResourceValues, resState.Outputs), outputs.ResourceSecrets)
 				}
-				return out, fmt.Errorf("provision request returned no output")
 			}
-			var outputs ProvisionerOutputs
-			dec := json.NewDecoder(bytes.NewReader(rawOutputs))
-			dec.DisallowUnknownFields()
-			if err := dec.Decode(&outputs); err != nil {
-				slog.Debug("invalid provisioner outputs", slog.String("raw", string(rawOutputs)))
-				return out, fmt.Errorf("%s: failed to decode response from provisioner: %w", resUid, err)
+			if attemptErr != nil {
+				if po := resState.Extras.PendingOperation; po != nil && po.ProvisionerId == provisioner.ProvisionerId {
+					if isTransientOperationError(err) {
+						// the remote operation was accepted, so falling back would orphan it; resume polling on the next run instead
+						out.Resources[resUid] = resState
+						return out, attemptErr
+					}
+					// the operation finished or failed for good, so polling it again would never succeed
+					resState.Extras.PendingOperation = nil
+					out.Resources[resUid] = resState
+					if cpErr := runCheckpoint(checkpoint, out); cpErr != nil {
+						return out, errors.Join(attemptErr, cpErr)
+					}
+				}
+				if provisioner.Fallback {
+					slog.Warn("Provisioner failed, trying the next matching provisioner", slog.String("uid", string(resUid)), slog.String("provisioner", provisioner.ProvisionerId), slog.String("err", attemptErr.Error()))
+					fallbackErrs = append(fallbackErrs, attemptErr)
+					continue
+				}
+				return out, attemptErr
 			}
 			resState.ProvisionerUri = provisioner.ProvisionerId
+			resState.Extras.PendingOperation = nil
 			resState.State = internal.Or(outputs.ResourceState, resState.State, map[string]interface{}{})
 			resState.Outputs = internal.Or(outputs.ResourceValues, resState.Outputs, map[string]interface{}{})
 			if outputs.ResourceSecrets != nil {
@@ -132,10 +180,26 @@ ResourceLoop:
 			slog.Info("Provisioned resource", slog.String("uid", string(resUid)))
 			continue ResourceLoop
 		}
+		if builtin, ok := builtinProvisioners[resState.Type]; ok && builtin.Provision != nil && len(fallbackErrs) == 0 {
+			outputs, err := builtin.Provision(out, resUid, resState)
+			if err != nil {
+				return out, fmt.Errorf("%s: failed to provision with builtin provisioner: %w", resUid, err)
+			}
+			resState.ProvisionerUri = BuiltinProvisionerPrefix + resState.Type
+			resState.Extras.PendingOperation = nil
+			resState.State = internal.Or(outputs.ResourceState, map[string]interface{}{})
+			resState.Outputs = internal.Or(outputs.ResourceValues, map[string]interface{}{})
+			out.Resources[resUid] = resState
+			slog.Info("Provisioned resource with builtin provisioner", slog.String("uid", string(resUid)))
+			continue ResourceLoop
+		}
 		// Never successfully provisioned so drop it from the state map otherwise we won't be able to de-provision it.
-		if resState.ProvisionerUri == "" {
+		if resState.ProvisionerUri == "" && resState.Extras.PendingOperation == nil {
 			delete(out.Resources, resUid)
 		}
+		if len(fallbackErrs) > 0 {
+			return out, fmt.Errorf("all matching provisioners failed for '%s.%s#%s': %w", resState.Type, resState.Class, resState.Id, errors.Join(fallbackErrs...))
+		}
 		return out, fmt.Errorf("failed to find a provisioner for '%s.%s#%s'", resState.Type, resState.Class, resState.Id)
 	}
 
@@ -151,7 +215,22 @@ ResourceLoop:
 	return out, nil
 }
 
-func DeProvisionResource(currentState *state.State, uid framework.ResourceUid) (*state.State, error) {
+func checkExpectedOutputs(uid framework.ResourceUid, provisioner state.Provisioner, values, secrets map[string]interface{}) error {
+	missingValues, missingSecrets := provisioner.MissingOutputs(values, secrets)
+	parts := make([]string, 0, 2)
+	if len(missingValues) > 0 {
+		parts = append(parts, fmt.Sprintf("missing values [%s]", strings.Join(missingValues, ", ")))
+	}
+	if len(missingSecrets) > 0 {
+		parts = append(parts, fmt.Sprintf("missing secrets [%s]", strings.Join(missingSecrets, ", ")))
+	}
+	if len(parts) > 0 {
+		return fmt.Errorf("%s: provisioner '%s' did not return the expected outputs: %s", uid, provisioner.ProvisionerId, strings.Join(parts, ", "))
+	}
+	return nil
+}
+
+func DeProvisionResource(currentState *state.State, uid framework.ResourceUid, checkpoint Checkpoint) (*state.State, error) {
 	out := currentState
 
 	rs, ok := currentState.Resources[uid]
@@ -159,6 +238,29 @@ func DeProvisionResource(currentState *state.State, uid framework.ResourceUid) (
 		return nil, fmt.Errorf("no such resource exists")
 	}
 
+	if rs.ProvisionerUri == "" && rs.Extras.PendingOperation != nil {
+		// the first provision operation has not completed, so ask the provisioner that accepted it to clean up and
+		// remember it in case the deprovision operation fails too
+		rs.ProvisionerUri = rs.Extras.PendingOperation.ProvisionerId
+	} else if rs.ProvisionerUri == "" {
+		out.Resources = maps.Clone(out.Resources)
+		delete(out.Resources, uid)
+		slog.Info("Removed never provisioned resource state from state file", slog.String("uid", string(uid)))
+		return out, nil
+	}
+
+	if strings.HasPrefix(rs.ProvisionerUri, BuiltinProvisionerPrefix) {
+		if builtin := builtinProvisioners[strings.TrimPrefix(rs.ProvisionerUri, BuiltinProvisionerPrefix)]; builtin.DeProvision != nil {
+			if err := builtin.DeProvision(out, uid, rs); err != nil {
+				return out, fmt.Errorf("%s: failed to deprovision with builtin provisioner: %w", uid, err)
+			}
+		}
+		out.Resources = maps.Clone(out.Resources)
+		delete(out.Resources, uid)
+		slog.Info("Removed builtin resource state from state file", slog.String("uid", string(uid)))
+		return out, nil
+	}
+
 	pId := slices.IndexFunc(out.Extras.Provisioners, func(provisioner state.Provisioner) bool {
 		return provisioner.ProvisionerId == rs.ProvisionerUri
 	})
@@ -181,7 +283,17 @@ func DeProvisionResource(currentState *state.State, uid framework.ResourceUid) (
 	var rawOutputs []byte
 	var err error
 	if provisioner.Http != nil {
-		rawOutputs, err = doHttpRequest(provisioner.Http, http.MethodDelete, inputs)
+		var pendingUrl string
+		if po := rs.Extras.PendingOperation; po != nil && po.ProvisionerId == provisioner.ProvisionerId && po.Method == http.MethodDelete {
+			slog.Info("Resuming pending deprovision operation", slog.String("uid", string(uid)), slog.String("url", po.Url))
+			pendingUrl = po.Url
+		}
+		rawOutputs, err = doHttpRequest(provisioner.Http, http.MethodDelete, inputs, pendingUrl, func(operationUrl string) error {
+			rs.Extras.PendingOperation = &state.PendingOperation{ProvisionerId: provisioner.ProvisionerId, Method: http.MethodDelete, Url: operationUrl}
+			out.Resources = maps.Clone(out.Resources)
+			out.Resources[uid] = rs
+			return runCheckpoint(checkpoint, out)
+		})
 	} else if provisioner.Cmd != nil {
 		rawOutputs, err = doCmdRequest(provisioner.Cmd, "deprovision", inputs)
 	} else if provisioner.Static != nil {
@@ -189,13 +301,19 @@ func DeProvisionResource(currentState *state.State, uid framework.ResourceUid) (
 	} else {
 		return out, fmt.Errorf("%s: provisioner is missing cmd or http section", uid)
 	}
+	if err != nil && len(rawOutputs) == 0 {
+		return out, clearFailedOperation(out, uid, rs, err, fmt.Errorf("%s: failed to call provisioner: %w", uid, err), checkpoint)
+	}
 	var outputs ProvisionerOutputs
-	dec := json.NewDecoder(bytes.NewReader(rawOutputs))
-	dec.DisallowUnknownFields()
-	if err := dec.Decode(&outputs); err != nil {
-		slog.Debug("invalid provisioner outputs", slog.String("raw", string(rawOutputs)))
-		return out, fmt.Errorf("%s: failed to decode response from provisioner: %w", uid, err)
+	if len(bytes.TrimSpace(rawOutputs)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(rawOutputs))
+		dec.DisallowUnknownFields()
+		if decErr := dec.Decode(&outputs); decErr != nil {
+			slog.Debug("invalid provisioner outputs", slog.String("raw", string(rawOutputs)))
+			return out, clearFailedOperation(out, uid, rs, err, fmt.Errorf("%s: failed to decode response from provisioner: %w", uid, decErr), checkpoint)
+		}
 	}
+	out.Resources = maps.Clone(out.Resources)
 	delete(out.Resources, uid)
 	out.SharedState = internal.PatchMap(out.SharedState, internal.Or(outputs.SharedState, make(map[string]interface{})))
 	if err != nil {
@@ -205,6 +323,21 @@ func DeProvisionResource(currentState *state.State, uid framework.ResourceUid) (
 	return out, nil
 }
 
+// clearFailedOperation drops the pending deprovision operation of the resource unless the call failed with a transient
+// error, so that the next attempt sends a new request rather than polling an operation that will never succeed.
+func clearFailedOperation(s *state.State, uid framework.ResourceUid, rs framework.ScoreResourceState[state.ResourceExtras], callErr error, resultErr error, checkpoint Checkpoint) error {
+	if rs.Extras.PendingOperation == nil || isTransientOperationError(callErr) {
+		return resultErr
+	}
+	rs.Extras.PendingOperation = nil
+	s.Resources = maps.Clone(s.Resources)
+	s.Resources[uid] = rs
+	if err := runCheckpoint(checkpoint, s); err != nil {
+		return errors.Join(resultErr, err)
+	}
+	return resultErr
+}
+
 type ProvisionerInputs struct {
 	ResourceUid   string                 `json:"resource_uid"`
 	ResourceType  string                 `json:"resource_type"`
@@ -257,7 +390,41 @@ func doCmdRequest(c *state.CmdProvisioner, op string, inputs ProvisionerInputs)
 	return outputBuffer.Bytes(), nil
 }
 
-func doHttpRequest(h *state.HttpProvisioner, method string, inputs ProvisionerInputs) ([]byte, error) {
+const (
+	defaultHttpPollTimeout = 30 * time.Minute
+	httpPollMaxInterval    = 30 * time.Second
+)
+
+// errHttpOperationFailed is returned when an asynchronous operation completes with a failure status. Unlike a timeout or
+// transport error, polling the same operation again will not succeed.
+var errHttpOperationFailed = errors.New("http provision operation failed")
+
+// isTransientOperationError returns true if the provisioner call failed in a way that polling the pending operation
+// again may recover from.
+func isTransientOperationError(err error) bool {
+	return err != nil && !errors.Is(err, errHttpOperationFailed)
+}
+
+// httpPollInitialInterval is the first delay between polls of an asynchronous operation, this doubles on each attempt.
+var httpPollInitialInterval = 2 * time.Second
+
+func runCheckpoint(checkpoint Checkpoint, s *state.State) error {
+	if checkpoint == nil {
+		return nil
+	}
+	if err := checkpoint(s); err != nil {
+		return fmt.Errorf("failed to checkpoint state: %w", err)
+	}
+	return nil
+}
+
+// doHttpRequest sends the provisioner request. If the provisioner accepts the request asynchronously with a 202 status
+// code, the operation url is passed to onAccepted and then polled until it completes. If pendingUrl is set, the initial
+// request is skipped and the existing operation is polled instead.
+func doHttpRequest(h *state.HttpProvisioner, method string, inputs ProvisionerInputs, pendingUrl string, onAccepted func(operationUrl string) error) ([]byte, error) {
+	if pendingUrl != "" {
+		return pollHttpOperation(h, pendingUrl)
+	}
 	raw, _ := json.Marshal(inputs)
 	req, err := http.NewRequest(method, h.Url, io.NopCloser(bytes.NewReader(raw)))
 	if err != nil {
@@ -275,10 +442,92 @@ func doHttpRequest(h *state.HttpProvisioner, method string, inputs ProvisionerIn
 	bod, _ := io.ReadAll(res.Body)
 	if res.StatusCode >= 300 {
 		return bod, fmt.Errorf("http provision request failed with status: %d %s: '%s'", res.StatusCode, res.Status, string(bod))
+	} else if res.StatusCode == http.StatusAccepted {
+		operationUrl, err := resolveOperationUrl(h.Url, res.Header.Get("Location"), bod)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Http provisioner accepted the request asynchronously, polling for completion", slog.String("url", operationUrl))
+		if onAccepted != nil {
+			if err := onAccepted(operationUrl); err != nil {
+				return nil, err
+			}
+		}
+		return pollHttpOperation(h, operationUrl)
 	}
 	return bod, nil
 }
 
+// resolveOperationUrl determines the url to poll for an accepted operation. This is either the Location header relative
+// to the provisioner url, or the provisioner url with an operation_id query parameter from the response body.
+func resolveOperationUrl(provisionerUrl string, location string, body []byte) (string, error) {
+	base, err := url.Parse(provisionerUrl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse provisioner url: %w", err)
+	}
+	if location != "" {
+		lu, err := url.Parse(location)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse Location header '%s': %w", location, err)
+		}
+		return base.ResolveReference(lu).String(), nil
+	}
+	var accepted struct {
+		OperationId string `json:"operation_id"`
+	}
+	if err := json.Unmarshal(body, &accepted); err != nil || accepted.OperationId == "" {
+		return "", fmt.Errorf("http provisioner returned 202 Accepted without a Location header or operation_id")
+	}
+	q := base.Query()
+	q.Set("operation_id", accepted.OperationId)
+	base.RawQuery = q.Encode()
+	return base.String(), nil
+}
+
+// pollHttpOperation issues GET requests to the operation url with an exponential backoff until it returns a non-202
+// status code or the poll timeout is reached.
+func pollHttpOperation(h *state.HttpProvisioner, operationUrl string) ([]byte, error) {
+	timeout := defaultHttpPollTimeout
+	if h.PollTimeout != "" {
+		d, err := time.ParseDuration(h.PollTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid poll timeout '%s': %w", h.PollTimeout, err)
+		}
+		timeout = d
+	}
+	deadline := time.Now().Add(timeout)
+	interval := httpPollInitialInterval
+	for {
+		req, err := http.NewRequest(http.MethodGet, operationUrl, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build poll request: %w", err)
+		}
+		req.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send poll request: %w", err)
+		}
+		bod, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if res.StatusCode >= 300 {
+			return bod, fmt.Errorf("%w with status: %d %s: '%s'", errHttpOperationFailed, res.StatusCode, res.Status, string(bod))
+		} else if res.StatusCode != http.StatusAccepted {
+			return bod, nil
+		}
+
+		wait := interval
+		if ra, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && ra > 0 {
+			wait = time.Duration(ra) * time.Second
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, fmt.Errorf("timed out after %s waiting for http provision operation '%s' to complete, run the command again to resume", timeout, operationUrl)
+		}
+		slog.Debug("Http provision operation is still in progress", slog.String("url", operationUrl), slog.Duration("wait", wait))
+		time.Sleep(wait)
+		interval = min(interval*2, httpPollMaxInterval)
+	}
+}
+
 func MapOutputLookupFunc(s map[string]interface{}) framework.OutputLookupFunc {
 	return func(keys ...string) (interface{}, error) {
 		var resolvedValue interface{}
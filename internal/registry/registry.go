@@ -0,0 +1,290 @@
+package registry
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+	dockerHubAuthKey  = "https://index.docker.io/v1/"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Reference is a parsed image reference.
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference such as nginx, ghcr.io/org/app:v1, or localhost:5000/app@sha256:... using
+// the same defaults as docker for the registry, library repositories, and the latest tag.
+func ParseReference(image string) (*Reference, error) {
+	out := &Reference{}
+	remainder := image
+	if before, after, ok := strings.Cut(remainder, "@"); ok {
+		remainder, out.Digest = before, after
+	}
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		remainder, out.Tag = remainder[:i], remainder[i+1:]
+	}
+	if first, rest, ok := strings.Cut(remainder, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		out.Registry, out.Repository = first, rest
+	} else {
+		out.Registry, out.Repository = dockerHubRegistry, remainder
+		if !strings.Contains(remainder, "/") {
+			out.Repository = "library/" + remainder
+		}
+	}
+	if out.Registry == "docker.io" || out.Registry == "index.docker.io" {
+		out.Registry = dockerHubRegistry
+	}
+	if out.Repository == "" || strings.ToLower(out.Repository) != out.Repository {
+		return nil, fmt.Errorf("invalid image reference '%s'", image)
+	} else if out.Tag == "" && out.Digest == "" {
+		out.Tag = "latest"
+	}
+	return out, nil
+}
+
+// Client resolves image tags to digests through the OCI distribution api.
+type Client struct {
+	HttpClient *http.Client
+	// Credentials returns the username and password for a registry, or empty strings for anonymous access.
+	Credentials func(registry string) (string, string, error)
+}
+
+// NewClient returns a client that uses credentials from the docker config file.
+func NewClient() *Client {
+	return &Client{HttpClient: http.DefaultClient, Credentials: DockerConfigCredentials}
+}
+
+// ResolveDigest returns the digest of the manifest that the reference points to.
+func (c *Client) ResolveDigest(ctx context.Context, ref *Reference) (string, error) {
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme(ref.Registry), ref.Registry, ref.Repository, ref.Tag)
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		res, body, err := c.do(ctx, method, u, ref)
+		if err != nil {
+			return "", err
+		} else if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("failed to get manifest %s/%s:%s: %s", ref.Registry, ref.Repository, ref.Tag, res.Status)
+		} else if d := res.Header.Get("Docker-Content-Digest"); d != "" {
+			return d, nil
+		} else if method == http.MethodGet {
+			sum := sha256.Sum256(body)
+			return "sha256:" + hex.EncodeToString(sum[:]), nil
+		}
+	}
+	return "", errors.New("unreachable")
+}
+
+// do sends the request and retries it once with credentials if the registry responds with an auth challenge.
+func (c *Client) do(ctx context.Context, method string, u string, ref *Reference) (*http.Response, []byte, error) {
+	send := func(authorization string) (*http.Response, []byte, error) {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build request: %w", err)
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		slog.Debug("Making registry request", slog.String("method", method), slog.String("url", u))
+		res, err := c.HttpClient.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return res, body, err
+	}
+	res, body, err := send("")
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, body, err
+	}
+	username, password, err := c.Credentials(ref.Registry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get credentials for %s: %w", ref.Registry, err)
+	}
+	challenge := res.Header.Get("WWW-Authenticate")
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+		if username == "" {
+			return nil, nil, fmt.Errorf("registry %s requires credentials, use docker login", ref.Registry)
+		}
+		return send("Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+	token, err := c.fetchToken(ctx, challenge, ref, username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return send("Bearer " + token)
+}
+
+// fetchToken exchanges the credentials for a bearer token from the realm of the challenge.
+func (c *Client) fetchToken(ctx context.Context, challenge string, ref *Reference, username, password string) (string, error) {
+	params := parseChallenge(challenge)
+	if params["realm"] == "" {
+		return "", fmt.Errorf("unsupported auth challenge from %s: '%s'", ref.Registry, challenge)
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid auth realm '%s': %w", params["realm"], err)
+	}
+	q := u.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	q.Set("scope", cmp.Or(params["scope"], "repository:"+ref.Repository+":pull"))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build token request: %w", err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	res, err := c.HttpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send token request: %w", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get registry token for %s: %s", ref.Registry, res.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	return cmp.Or(token.Token, token.AccessToken), nil
+}
+
+// parseChallenge parses the key="value" parameters of a WWW-Authenticate header.
+func parseChallenge(challenge string) map[string]string {
+	out := make(map[string]string)
+	_, params, _ := strings.Cut(challenge, " ")
+	for params != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, ", "), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, params, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+		}
+		out[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return out
+}
+
+// scheme returns http for loopback registries, such as a local test registry, and https for everything else.
+func scheme(registry string) string {
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return "http"
+	}
+	return "https"
+}
+
+// DockerConfigCredentials reads the credentials for the registry from $DOCKER_CONFIG/config.json or
+// ~/.docker/config.json, using a credential helper if one is configured.
+func DockerConfigCredentials(registry string) (string, string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("failed to read docker config: %w", err)
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+		CredsStore  string            `json:"credsStore"`
+		CredHelpers map[string]string `json:"credHelpers"`
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return "", "", fmt.Errorf("failed to decode docker config: %w", err)
+	}
+	key := registry
+	if registry == dockerHubRegistry {
+		key = dockerHubAuthKey
+	}
+	if helper := cmp.Or(config.CredHelpers[key], config.CredsStore); helper != "" {
+		return credentialHelper(helper, key)
+	}
+	for _, k := range []string{key, "https://" + key, "http://" + key} {
+		if entry, ok := config.Auths[k]; ok && entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to decode docker config auth for %s: %w", k, err)
+			}
+			username, password, _ := strings.Cut(string(decoded), ":")
+			return username, password, nil
+		}
+	}
+	return "", "", nil
+}
+
+// credentialHelper runs docker-credential-<helper> get for the registry.
+func credentialHelper(helper string, key string) (string, string, error) {
+	c := exec.Command("docker-credential-"+helper, "get")
+	c.Stdin = strings.NewReader(key)
+	stdout := new(bytes.Buffer)
+	c.Stdout = stdout
+	if err := c.Run(); err != nil {
+		// helpers exit non-zero when there are no credentials for the registry
+		slog.Debug("Docker credential helper returned no credentials", slog.String("helper", helper), slog.String("registry", key), slog.String("err", err.Error()))
+		return "", "", nil
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", fmt.Errorf("failed to decode credential helper output: %w", err)
+	}
+	return creds.Username, creds.Secret, nil
+}
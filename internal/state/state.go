@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/score-spec/score-go/framework"
@@ -29,21 +30,36 @@ const (
 	DefaultRelativeStateDirectory = ".score-flyio"
 	FileName                      = "state.yaml"
 	SharedStateAppPrefixKey       = "score-flyio-app-prefix"
+	SharedStateRegionKey          = "score-flyio-region"
 )
 
 type StateExtras struct {
-	AppPrefix    string        `yaml:"app_prefix"`
-	Provisioners []Provisioner `yaml:"provisioners"`
+	AppPrefix string `yaml:"app_prefix"`
+	// PrimaryRegion is the Fly region that apps and provisioned resources are placed in by default.
+	PrimaryRegion string `yaml:"primary_region,omitempty"`
+	// PrivateServices is the default for whether service ports are only reachable through a Flycast private ip.
+	PrivateServices bool          `yaml:"private_services,omitempty"`
+	Provisioners    []Provisioner `yaml:"provisioners"`
 }
 
 type Provisioner struct {
-	ProvisionerId string                  `yaml:"id"`
-	ResourceType  string                  `yaml:"resource_type"`
-	ResourceClass string                  `yaml:"resource_class,omitempty"`
-	ResourceId    string                  `yaml:"resource_id,omitempty"`
-	Cmd           *CmdProvisioner         `yaml:"cmd,omitempty"`
-	Http          *HttpProvisioner        `yaml:"http,omitempty"`
-	Static        *map[string]interface{} `yaml:"static,omitempty"`
+	ProvisionerId string `yaml:"id"`
+	// ResourceType, ResourceClass, and ResourceId are glob patterns as supported by path.Match. An empty class or id
+	// matches any value.
+	ResourceType  string `yaml:"resource_type"`
+	ResourceClass string `yaml:"resource_class,omitempty"`
+	ResourceId    string `yaml:"resource_id,omitempty"`
+	// ResourceAnnotations is a set of glob patterns which must all match the corresponding annotations in the resource
+	// metadata.
+	ResourceAnnotations map[string]string `yaml:"resource_annotations,omitempty"`
+	// Fallback indicates that if this provisioner fails, the next matching provisioner should be tried.
+	Fallback bool `yaml:"fallback,omitempty"`
+	// ExpectedValues and ExpectedSecrets are the output keys that the provisioner must return for each resource.
+	ExpectedValues  []string                `yaml:"expected_values,omitempty"`
+	ExpectedSecrets []string                `yaml:"expected_secrets,omitempty"`
+	Cmd             *CmdProvisioner         `yaml:"cmd,omitempty"`
+	Http            *HttpProvisioner        `yaml:"http,omitempty"`
+	Static          *map[string]interface{} `yaml:"static,omitempty"`
 }
 
 type CmdProvisioner struct {
@@ -53,11 +69,27 @@ type CmdProvisioner struct {
 
 type HttpProvisioner struct {
 	Url string `json:"url"`
+	// PollTimeout is the maximum duration to wait for an asynchronous (202 Accepted) operation to complete.
+	PollTimeout string `yaml:"poll_timeout,omitempty" json:"poll_timeout,omitempty"`
 }
 
-type WorkloadExtras struct{}
+type WorkloadExtras struct {
+	// PinnedImages maps container names to the image reference with the digest that the image tag resolved to when
+	// generated with --pin-images.
+	PinnedImages map[string]string `yaml:"pinned_images,omitempty"`
+}
+
+type ResourceExtras struct {
+	// PendingOperation is set while an asynchronous http provisioner operation is in-flight so that an interrupted
+	// generate or deprovision can resume polling rather than issuing a new request.
+	PendingOperation *PendingOperation `yaml:"pending_operation,omitempty"`
+}
 
-type ResourceExtras struct{}
+type PendingOperation struct {
+	ProvisionerId string `yaml:"provisioner"`
+	Method        string `yaml:"method"`
+	Url           string `yaml:"url"`
+}
 
 type State = framework.State[StateExtras, WorkloadExtras, ResourceExtras]
 
@@ -114,6 +146,38 @@ func LoadStateDirectory(directory string) (*StateDirectory, bool, error) {
 	return &StateDirectory{d, out}, true, nil
 }
 
-func (p *Provisioner) Matches(uid framework.ResourceUid) bool {
-	return p.ResourceType == uid.Type() && (p.ResourceClass == "" || p.ResourceClass == uid.Class()) && (p.ResourceId == "" || p.ResourceId == uid.Id())
+// Matches returns true if the provisioner type, class, id, and annotation patterns all match the given resource.
+func (p *Provisioner) Matches(uid framework.ResourceUid, metadata map[string]interface{}) bool {
+	if !globMatches(p.ResourceType, uid.Type()) || (p.ResourceClass != "" && !globMatches(p.ResourceClass, uid.Class())) || (p.ResourceId != "" && !globMatches(p.ResourceId, uid.Id())) {
+		return false
+	}
+	if len(p.ResourceAnnotations) > 0 {
+		annotations, _ := metadata["annotations"].(map[string]interface{})
+		for k, pattern := range p.ResourceAnnotations {
+			if v, ok := annotations[k].(string); !ok || !globMatches(pattern, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// MissingOutputs returns the expected value and secret keys which are not present in the given outputs.
+func (p *Provisioner) MissingOutputs(values, secrets map[string]interface{}) (missingValues []string, missingSecrets []string) {
+	for _, k := range p.ExpectedValues {
+		if _, ok := values[k]; !ok {
+			missingValues = append(missingValues, k)
+		}
+	}
+	for _, k := range p.ExpectedSecrets {
+		if _, ok := secrets[k]; !ok {
+			missingSecrets = append(missingSecrets, k)
+		}
+	}
+	return
+}
+
+func globMatches(pattern, value string) bool {
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
 }